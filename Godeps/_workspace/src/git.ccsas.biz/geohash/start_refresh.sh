@@ -1,3 +0,0 @@
-#!/bin/bash
-
-reflex -r '\.go$' -s ./refresh_app.sh
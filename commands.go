@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/vitaminwater/parsemap/services"
+)
+
+/**
+ * Commands
+ * parsemap [-c config] command [arguments]
+ */
+
+func runCommand(args []string) {
+	switch args[0] {
+	case "rebuild-zones":
+		rebuildZonesCommand(args[1:])
+	case "import":
+		importCommand(args[1:])
+	default:
+		log.Fatalf("Unknown command %s", args[0])
+	}
+}
+
+func rebuildZonesCommand(args []string) {
+	flags := flag.NewFlagSet("rebuild-zones", flag.ExitOnError)
+	list := flags.String("list", "", "Identifier of the list to rebuild")
+	flags.Parse(args)
+
+	if len(*list) == 0 {
+		log.Fatal("Missing --list")
+	}
+	if err := services.RebuildListZones(*list, os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func importCommand(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	list := flags.String("list", "", "Identifier of the list to import the points to")
+	format := flags.String("format", "", "csv, ndjson or geojson, defaults to the extension of the file")
+	provider := flags.String("provider", "", "Provider of the points without one")
+	noEvent := flags.Bool("no-event", false, "Do not create an event per point")
+	flags.Parse(args)
+
+	if len(*list) == 0 {
+		log.Fatal("Missing --list")
+	}
+	if flags.NArg() != 1 {
+		log.Fatal("Missing file, - for the standard input")
+	}
+
+	file := os.Stdin
+	if flags.Arg(0) != "-" {
+		var err error
+		if file, err = os.Open(flags.Arg(0)); err != nil {
+			log.Fatal(err)
+		}
+		defer file.Close()
+	}
+	if len(*format) == 0 {
+		*format = services.ImportFormat(flags.Arg(0))
+	}
+
+	nPoints, err := services.ImportListPoints(*list, *format, *provider, *noEvent, file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%d points imported to list %s\n", nPoints, *list)
+}
@@ -0,0 +1,57 @@
+//go:build geohash_cgo
+// +build geohash_cgo
+
+package geohash
+
+// the C library the package replaces, kept to compare the outputs, see
+// geohash_cgo_test.go
+
+// #cgo LDFLAGS: -lgeohash
+// #include <geohash/geohash.h>
+// #include <stdlib.h>
+// #include <string.h>
+import "C"
+
+import (
+	"unsafe"
+)
+
+func newCGeohash(geohash string) *C.CCGeohashStruct {
+	cgeohash := C.CString(geohash)
+	defer C.free(unsafe.Pointer(cgeohash))
+	cg := &C.CCGeohashStruct{}
+	C.memset(unsafe.Pointer(&(cg.hash[0])), '0', MaxGeohashLength)
+	C.strncpy(&(cg.hash[0]), cgeohash, C.size_t(len(geohash)))
+	C.init_from_hash(cg)
+	return cg
+}
+
+func cGeohashFromCoordinates(latitude float64, longitude float64) string {
+	cg := &C.CCGeohashStruct{latitude: C.double(latitude), longitude: C.double(longitude)}
+	C.init_from_coordinates(cg)
+	return C.GoString(&(cg.hash[0]))
+}
+
+func cCoordinatesFromGeohash(geohash string) (float64, float64) {
+	cg := newCGeohash(geohash)
+	return float64(cg.latitude), float64(cg.longitude)
+}
+
+// the loop of the removed binding, the offsets of init_neighbour are in
+// cells of MaxGeohashLength digits, computed on int8
+func cGeohashGridSurroundingGeohash(geohash string, radius int8) []string {
+	digits := int8(len(geohash))
+	cg := newCGeohash(geohash)
+
+	power := MaxGeohashLength - digits
+	digitsToMultiplier := power * power
+	result := []string{}
+	for i := -radius; i <= radius; i++ {
+		for j := -radius; j <= radius; j++ {
+			neighbour := C.init_neighbour(cg, C.int(j*digitsToMultiplier), C.int(i*digitsToMultiplier))
+			hash := C.GoString(&(neighbour.hash[0]))
+			result = append(result, hash[:digits])
+		}
+	}
+	return result
+}
@@ -0,0 +1,171 @@
+package geohash
+
+import (
+	"fmt"
+	"math"
+)
+
+/**
+ * Quadtree geohash
+ * the layout of the C library the package replaces, the cells are squares
+ * of 180/2^n degrees, the first digit splits the world in 4 columns and 2
+ * rows, the other digits halve the cell on both axes, the longitude bits
+ * are the high bits of a digit and the latitude bit the low one:
+ *
+ *   first digit    other digits
+ *   1 3 5 7        1 3
+ *   0 2 4 6        0 2
+ *
+ * a geohash of length n covers 180/2^n degrees of latitude and of
+ * longitude, Paris is under 5.
+ */
+
+const MaxGeohashLength = 17
+
+// columns returns the number of cells on the longitude axis at the given
+// length.
+func columns(length int) int {
+	if length == 0 {
+		return 1
+	}
+	return 1 << uint(length+1)
+}
+
+// rows returns the number of cells on the latitude axis at the given length.
+func rows(length int) int {
+	return 1 << uint(length)
+}
+
+// cellCoordinates returns the column and row of the cell of the given length
+// containing the coordinates, from the south west corner of the world.
+func cellCoordinates(latitude, longitude float64, length int) (int, int) {
+	nx, ny := columns(length), rows(length)
+	x := int(math.Floor((longitude + 180) / 360 * float64(nx)))
+	y := int(math.Floor((latitude + 90) / 180 * float64(ny)))
+	return clamp(x, 0, nx-1), clamp(y, 0, ny-1)
+}
+
+func clamp(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+// encode returns the geohash of the cell at column x and row y.
+func encode(x, y, length int) string {
+	hash := make([]byte, length)
+	for i := length - 1; i > 0; i-- {
+		hash[i] = byte('0' + ((x&1)<<1 | y&1))
+		x, y = x>>1, y>>1
+	}
+	if length > 0 {
+		hash[0] = byte('0' + (x<<1 | y))
+	}
+	return string(hash)
+}
+
+// decode returns the column and row of the cell of the geohash.
+func decode(hash string) (int, int, error) {
+	x, y := 0, 0
+	for i := 0; i < len(hash); i++ {
+		digit := int(hash[i]) - '0'
+		if digit < 0 || (i == 0 && digit > 7) || (i > 0 && digit > 3) {
+			return 0, 0, fmt.Errorf("Wrong geohash digit %q", hash[i])
+		}
+		x = x<<1 | digit>>1
+		y = y<<1 | digit&1
+	}
+	return x, y, nil
+}
+
+// Valid tests whether the geohash has at most MaxGeohashLength digits, the
+// first one between '0' and '7' and the others between '0' and '3'.
+func Valid(geohash string) bool {
+	if len(geohash) > MaxGeohashLength {
+		return false
+	}
+	_, _, err := decode(geohash)
+	return err == nil
+}
+
+func GeohashFromCoordinates(latitude float64, longitude float64) string {
+	x, y := cellCoordinates(latitude, longitude, MaxGeohashLength)
+	return encode(x, y, MaxGeohashLength)
+}
+
+// CoordinatesFromGeohash returns the center of the cell of the geohash
+// padded with '0' to MaxGeohashLength digits, which is inside the cell of the
+// geohash.
+func CoordinatesFromGeohash(geohash string) (float64, float64) {
+	if len(geohash) > MaxGeohashLength {
+		geohash = geohash[:MaxGeohashLength]
+	}
+	x, y, err := decode(geohash)
+	if err != nil {
+		return 0, 0
+	}
+	padding := uint(MaxGeohashLength - len(geohash))
+	x, y = x<<padding, y<<padding
+
+	latitude := (float64(y)+0.5)*180/float64(rows(MaxGeohashLength)) - 90
+	longitude := (float64(x)+0.5)*360/float64(columns(MaxGeohashLength)) - 180
+	return latitude, longitude
+}
+
+// CoordinatesBoundsToGeohashes returns the geohashes of the given length
+// covering the bounds, row by row from the south west cell.
+func CoordinatesBoundsToGeohashes(latitudeMin, longitudeMin, latitudeMax, longitudeMax float64, length int) []string {
+	if length <= 0 {
+		return []string{""}
+	}
+	if length > MaxGeohashLength {
+		length = MaxGeohashLength
+	}
+	xMin, yMin := cellCoordinates(latitudeMin, longitudeMin, length)
+	xMax, yMax := cellCoordinates(latitudeMax, longitudeMax, length)
+
+	result := []string{}
+	for y := yMin; y <= yMax; y++ {
+		for x := xMin; x <= xMax; x++ {
+			result = append(result, encode(x, y, length))
+		}
+	}
+	return result
+}
+
+// GeohashGridSurroundingGeohash returns the (2 * radius + 1)^2 cells around
+// the cell of the geohash, row by row from the south west cell, the
+// longitudes wrap around the antimeridian and the latitudes stop at the
+// poles. As in the C binding, the cells are offset from the south west
+// corner of the cell by (MaxGeohashLength - len(geohash))^2 cells of
+// MaxGeohashLength digits, computed on int8, which are the neighbours of the
+// cell only for lengths 13 and 15, Neighbour returns the neighbours at any
+// length.
+func GeohashGridSurroundingGeohash(geohash string, radius int8) ([]string, error) {
+	digits := len(geohash)
+	if digits > MaxGeohashLength {
+		return nil, fmt.Errorf("Geohash length cannot be > %d", MaxGeohashLength)
+	}
+	x, y, err := decode(geohash)
+	if err != nil {
+		return nil, err
+	}
+	power := int8(MaxGeohashLength - digits)
+	x, y = x<<uint(power), y<<uint(power)
+
+	multiplier := power * power
+	nx, ny := columns(MaxGeohashLength), rows(MaxGeohashLength)
+	result := []string{}
+	for i := -radius; i <= radius; i++ {
+		for j := -radius; j <= radius; j++ {
+			cx := ((x+int(j*multiplier))%nx + nx) % nx
+			cy := clamp(y+int(i*multiplier), 0, ny-1)
+			result = append(result, encode(cx, cy, MaxGeohashLength)[:digits])
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,69 @@
+//go:build geohash_cgo
+// +build geohash_cgo
+
+package geohash
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+/**
+ * Golden tests against the C library, run with
+ * go test -tags geohash_cgo ./geohash
+ * with libgeohash installed.
+ */
+
+func randomCoordinates() (float64, float64) {
+	return rand.Float64()*180 - 90, rand.Float64()*360 - 180
+}
+
+func TestGeohashFromCoordinatesGolden(t *testing.T) {
+	for i := 0; i < 100000; i++ {
+		latitude, longitude := randomCoordinates()
+		if geohash, want := GeohashFromCoordinates(latitude, longitude), cGeohashFromCoordinates(latitude, longitude); geohash != want {
+			t.Fatalf("GeohashFromCoordinates(%v, %v) = %s, C = %s", latitude, longitude, geohash, want)
+		}
+	}
+}
+
+func TestGeohashFromCoordinatesGoldenEdges(t *testing.T) {
+	// the poles, the antimeridian, the equator and the greenwich meridian
+	for _, latitude := range []float64{-90, -45, -0.000001, 0, 45, 90} {
+		for _, longitude := range []float64{-180, -90, -0.000001, 0, 90, 180} {
+			if geohash, want := GeohashFromCoordinates(latitude, longitude), cGeohashFromCoordinates(latitude, longitude); geohash != want {
+				t.Errorf("GeohashFromCoordinates(%v, %v) = %s, C = %s", latitude, longitude, geohash, want)
+			}
+		}
+	}
+}
+
+func TestCoordinatesFromGeohashGolden(t *testing.T) {
+	for i := 0; i < 100000; i++ {
+		latitude, longitude := randomCoordinates()
+		geohash := GeohashFromCoordinates(latitude, longitude)[:rand.Intn(MaxGeohashLength+1)]
+
+		lat, lon := CoordinatesFromGeohash(geohash)
+		wantLat, wantLon := cCoordinatesFromGeohash(geohash)
+		if lat != wantLat || lon != wantLon {
+			t.Fatalf("CoordinatesFromGeohash(%s) = %v, %v, C = %v, %v", geohash, lat, lon, wantLat, wantLon)
+		}
+	}
+}
+
+func TestGeohashGridSurroundingGeohashGolden(t *testing.T) {
+	for i := 0; i < 10000; i++ {
+		latitude, longitude := randomCoordinates()
+		geohash := GeohashFromCoordinates(latitude, longitude)[:1+rand.Intn(MaxGeohashLength)]
+		radius := int8(rand.Intn(4))
+
+		grid, err := GeohashGridSurroundingGeohash(geohash, radius)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := cGeohashGridSurroundingGeohash(geohash, radius); reflect.DeepEqual(grid, want) == false {
+			t.Fatalf("GeohashGridSurroundingGeohash(%s, %d) = %v, C = %v", geohash, radius, grid, want)
+		}
+	}
+}
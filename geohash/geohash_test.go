@@ -0,0 +1,130 @@
+package geohash
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGeohashFromCoordinates(t *testing.T) {
+	tests := []struct {
+		latitude, longitude float64
+		geohash             string
+	}{
+		{-90, -180, strings.Repeat("0", MaxGeohashLength)},
+		{90, 180, "7" + strings.Repeat("3", MaxGeohashLength-1)},
+		{0, 0, "5" + strings.Repeat("0", MaxGeohashLength-1)},
+		{-0.000001, -0.000001, "2" + strings.Repeat("3", MaxGeohashLength-1)},
+		{45, -90, "31" + strings.Repeat("0", MaxGeohashLength-2)},
+		// Paris is under 5, as with the C library
+		{48.8566, 2.3522, "51000123031331000"},
+	}
+	for _, test := range tests {
+		if geohash := GeohashFromCoordinates(test.latitude, test.longitude); geohash != test.geohash {
+			t.Errorf("GeohashFromCoordinates(%v, %v) = %s, want %s", test.latitude, test.longitude, geohash, test.geohash)
+		}
+	}
+}
+
+func TestCoordinatesFromGeohash(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		latitude := rand.Float64()*180 - 90
+		longitude := rand.Float64()*360 - 180
+		geohash := GeohashFromCoordinates(latitude, longitude)
+
+		for length := 0; length <= MaxGeohashLength; length++ {
+			lat, lon := CoordinatesFromGeohash(geohash[:length])
+			if decoded := GeohashFromCoordinates(lat, lon); strings.HasPrefix(decoded, geohash[:length]) == false {
+				t.Fatalf("CoordinatesFromGeohash(%s) = %v, %v, outside of the cell", geohash[:length], lat, lon)
+			}
+		}
+	}
+}
+
+func TestCoordinatesBoundsToGeohashes(t *testing.T) {
+	if geohashes := CoordinatesBoundsToGeohashes(-90, -180, 90, 180, 1); reflect.DeepEqual(geohashes, []string{"0", "2", "4", "6", "1", "3", "5", "7"}) == false {
+		t.Errorf("CoordinatesBoundsToGeohashes of the world = %v", geohashes)
+	}
+	if geohashes := CoordinatesBoundsToGeohashes(-90, -180, 90, 180, 0); reflect.DeepEqual(geohashes, []string{""}) == false {
+		t.Errorf("CoordinatesBoundsToGeohashes of length 0 = %v", geohashes)
+	}
+
+	geohashes := CoordinatesBoundsToGeohashes(48.8, 2.2, 48.9, 2.5, 10)
+	seen := map[string]bool{}
+	for _, geohash := range geohashes {
+		seen[geohash] = true
+	}
+	for i := 0; i < 1000; i++ {
+		latitude := 48.8 + rand.Float64()*0.1
+		longitude := 2.2 + rand.Float64()*0.3
+		if geohash := GeohashFromCoordinates(latitude, longitude)[:10]; seen[geohash] == false {
+			t.Fatalf("%v, %v in %s, not in the cover %v", latitude, longitude, geohash, geohashes)
+		}
+	}
+}
+
+func TestGeohashGridSurroundingGeohash(t *testing.T) {
+	// the cells are offset by (MaxGeohashLength - length)^2 cells of
+	// MaxGeohashLength digits from the south west corner of the cell, which
+	// stays in the cell with one digit less than MaxGeohashLength
+	geohash := GeohashFromCoordinates(48.8566, 2.3522)[:16]
+	grid, err := GeohashGridSurroundingGeohash(geohash, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	south, _ := Neighbour(geohash, South)
+	southWest, _ := Neighbour(geohash, SouthWest)
+	west, _ := Neighbour(geohash, West)
+	want := []string{southWest, south, south, west, geohash, geohash, west, geohash, geohash}
+	if reflect.DeepEqual(grid, want) == false {
+		t.Errorf("GeohashGridSurroundingGeohash(%s, 1) = %v, want %v", geohash, grid, want)
+	}
+
+	// the longitudes wrap, the latitudes stop at the poles
+	grid, err = GeohashGridSurroundingGeohash(strings.Repeat("1", 15), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grid[3] != "7"+strings.Repeat("3", 14) || grid[6] != grid[3] {
+		t.Errorf("GeohashGridSurroundingGeohash(111111111111111, 1) = %v", grid)
+	}
+
+	for _, length := range []int{13, 15} {
+		geohash := GeohashFromCoordinates(48.8566, 2.3522)[:length]
+		grid, err := GeohashGridSurroundingGeohash(geohash, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(grid) != 25 || grid[12] != geohash {
+			t.Errorf("GeohashGridSurroundingGeohash(%s, 2) = %v", geohash, grid)
+		}
+		seen := map[string]bool{}
+		for _, cell := range grid {
+			if len(cell) != length || seen[cell] {
+				t.Errorf("GeohashGridSurroundingGeohash(%s, 2) = %v, wrong or repeated cell %s", geohash, grid, cell)
+			}
+			seen[cell] = true
+		}
+	}
+
+	if _, err := GeohashGridSurroundingGeohash(strings.Repeat("0", MaxGeohashLength+1), 1); err == nil {
+		t.Error("GeohashGridSurroundingGeohash accepted a geohash too long")
+	}
+	if _, err := GeohashGridSurroundingGeohash("04", 1); err == nil {
+		t.Error("GeohashGridSurroundingGeohash accepted a wrong digit")
+	}
+}
+
+func TestValid(t *testing.T) {
+	for _, geohash := range []string{"", "0", "7", "5123", "7" + strings.Repeat("3", MaxGeohashLength-1)} {
+		if Valid(geohash) == false {
+			t.Errorf("Valid(%s) = false", geohash)
+		}
+	}
+	for _, geohash := range []string{"8", "05", "54", "a", "0%", strings.Repeat("3", MaxGeohashLength+1)} {
+		if Valid(geohash) {
+			t.Errorf("Valid(%s) = true", geohash)
+		}
+	}
+}
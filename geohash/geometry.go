@@ -0,0 +1,341 @@
+package geohash
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+/**
+ * Cell geometry
+ * bounds, parent, children and neighbours of the cells, and the cells
+ * covering a box, a polygon or a circle.
+ */
+
+// mean earth radius, in metres
+const EarthRadius = 6371008.8
+
+type Direction int
+
+const (
+	North Direction = iota
+	NorthEast
+	East
+	SouthEast
+	South
+	SouthWest
+	West
+	NorthWest
+)
+
+// the cells north of the north pole and south of the south pole do not exist
+var ErrNoNeighbour = errors.New("No neighbour past the pole")
+
+// Box is the area between two latitudes and two longitudes, LongitudeMin is
+// greater than LongitudeMax when the box crosses the antimeridian.
+type Box struct {
+	LatitudeMin  float64
+	LongitudeMin float64
+	LatitudeMax  float64
+	LongitudeMax float64
+}
+
+func (b Box) crossesAntimeridian() bool {
+	return b.LongitudeMin > b.LongitudeMax
+}
+
+// split returns the box as boxes that do not cross the antimeridian.
+func (b Box) split() []Box {
+	if b.crossesAntimeridian() == false {
+		return []Box{b}
+	}
+	return []Box{
+		{b.LatitudeMin, b.LongitudeMin, b.LatitudeMax, 180},
+		{b.LatitudeMin, -180, b.LatitudeMax, b.LongitudeMax},
+	}
+}
+
+// Bounds returns the area covered by the cell of the geohash.
+func Bounds(geohash string) (Box, error) {
+	if len(geohash) > MaxGeohashLength {
+		return Box{}, fmt.Errorf("Geohash length cannot be > %d", MaxGeohashLength)
+	}
+	x, y, err := decode(geohash)
+	if err != nil {
+		return Box{}, err
+	}
+	latitudeStep := 180 / float64(rows(len(geohash)))
+	longitudeStep := 360 / float64(columns(len(geohash)))
+	return Box{
+		float64(y)*latitudeStep - 90,
+		float64(x)*longitudeStep - 180,
+		float64(y+1)*latitudeStep - 90,
+		float64(x+1)*longitudeStep - 180,
+	}, nil
+}
+
+// Parent returns the geohash of the cell containing the cell of the
+// geohash, the parent of the empty geohash is the empty geohash.
+func Parent(geohash string) string {
+	if len(geohash) == 0 {
+		return geohash
+	}
+	return geohash[:len(geohash)-1]
+}
+
+// Children returns the cells of the cell of the geohash, eight for the
+// empty geohash and four for the others, nil when the geohash has
+// MaxGeohashLength digits.
+func Children(geohash string) []string {
+	if len(geohash) >= MaxGeohashLength {
+		return nil
+	}
+	digits := "0123"
+	if len(geohash) == 0 {
+		digits = "01234567"
+	}
+	children := []string{}
+	for _, digit := range digits {
+		children = append(children, geohash+string(digit))
+	}
+	return children
+}
+
+// Neighbour returns the cell of the same length next to the cell of the
+// geohash in the direction, the longitudes wrap around the antimeridian.
+func Neighbour(geohash string, direction Direction) (string, error) {
+	if len(geohash) > MaxGeohashLength {
+		return "", fmt.Errorf("Geohash length cannot be > %d", MaxGeohashLength)
+	}
+	x, y, err := decode(geohash)
+	if err != nil {
+		return "", err
+	}
+
+	dx, dy := 0, 0
+	switch direction {
+	case North:
+		dy = 1
+	case NorthEast:
+		dx, dy = 1, 1
+	case East:
+		dx = 1
+	case SouthEast:
+		dx, dy = 1, -1
+	case South:
+		dy = -1
+	case SouthWest:
+		dx, dy = -1, -1
+	case West:
+		dx = -1
+	case NorthWest:
+		dx, dy = -1, 1
+	default:
+		return "", fmt.Errorf("Wrong direction %d", direction)
+	}
+
+	nx, ny := columns(len(geohash)), rows(len(geohash))
+	if y+dy < 0 || y+dy >= ny {
+		return "", ErrNoNeighbour
+	}
+	return encode(((x+dx)%nx+nx)%nx, y+dy, len(geohash)), nil
+}
+
+// CoverBox returns the geohashes of the given length covering the box, the
+// empty geohash covers the whole world.
+func CoverBox(box Box, length int) []string {
+	if length <= 0 {
+		return []string{""}
+	}
+	result := []string{}
+	seen := map[string]bool{}
+	for _, b := range box.split() {
+		for _, geohash := range CoordinatesBoundsToGeohashes(b.LatitudeMin, b.LongitudeMin, b.LatitudeMax, b.LongitudeMax, length) {
+			if seen[geohash] == false {
+				seen[geohash] = true
+				result = append(result, geohash)
+			}
+		}
+	}
+	return result
+}
+
+/**
+ * Polygons
+ * a polygon is a list of rings of [longitude, latitude] positions, as in
+ * GeoJSON, the first ring is its exterior and the others are holes.
+ */
+
+// ringContains tests whether the position is inside the ring, by casting a
+// ray towards the east and counting the crossed edges.
+func ringContains(ring [][]float64, latitude, longitude float64) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		xi, yi := ring[i][0], ring[i][1]
+		xj, yj := ring[j][0], ring[j][1]
+		if (yi > latitude) != (yj > latitude) && longitude < (xj-xi)*(latitude-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// PolygonContains tests whether the position is inside the exterior of the
+// polygon and outside of its holes.
+func PolygonContains(polygon [][][]float64, latitude, longitude float64) bool {
+	if len(polygon) == 0 || ringContains(polygon[0], latitude, longitude) == false {
+		return false
+	}
+	for _, hole := range polygon[1:] {
+		if ringContains(hole, latitude, longitude) {
+			return false
+		}
+	}
+	return true
+}
+
+func segmentsIntersect(ax, ay, bx, by, cx, cy, dx, dy float64) bool {
+	cross := func(ox, oy, px, py, qx, qy float64) float64 {
+		return (px-ox)*(qy-oy) - (py-oy)*(qx-ox)
+	}
+	d1 := cross(cx, cy, dx, dy, ax, ay)
+	d2 := cross(cx, cy, dx, dy, bx, by)
+	d3 := cross(ax, ay, bx, by, cx, cy)
+	d4 := cross(ax, ay, bx, by, dx, dy)
+	return ((d1 > 0 && d2 < 0) || (d1 < 0 && d2 > 0)) && ((d3 > 0 && d4 < 0) || (d3 < 0 && d4 > 0))
+}
+
+// polygonIntersectsBox tests whether the polygon and the box have a common
+// area, when one contains a corner of the other, or when their edges cross.
+func polygonIntersectsBox(polygon [][][]float64, b Box) bool {
+	corners := [][]float64{
+		{b.LongitudeMin, b.LatitudeMin},
+		{b.LongitudeMax, b.LatitudeMin},
+		{b.LongitudeMax, b.LatitudeMax},
+		{b.LongitudeMin, b.LatitudeMax},
+	}
+	for _, corner := range corners {
+		if PolygonContains(polygon, corner[1], corner[0]) {
+			return true
+		}
+	}
+	for _, ring := range polygon {
+		for i := 1; i < len(ring); i++ {
+			x, y := ring[i][0], ring[i][1]
+			if x >= b.LongitudeMin && x <= b.LongitudeMax && y >= b.LatitudeMin && y <= b.LatitudeMax {
+				return true
+			}
+			for k := range corners {
+				c1, c2 := corners[k], corners[(k+1)%len(corners)]
+				if segmentsIntersect(ring[i-1][0], ring[i-1][1], x, y, c1[0], c1[1], c2[0], c2[1]) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// CoverPolygon returns the geohashes of the given length whose cells
+// intersect the polygon.
+func CoverPolygon(polygon [][][]float64, length int) []string {
+	if len(polygon) == 0 || len(polygon[0]) == 0 {
+		return []string{}
+	}
+	box := Box{90, 180, -90, -180}
+	for _, position := range polygon[0] {
+		box.LongitudeMin = math.Min(box.LongitudeMin, position[0])
+		box.LatitudeMin = math.Min(box.LatitudeMin, position[1])
+		box.LongitudeMax = math.Max(box.LongitudeMax, position[0])
+		box.LatitudeMax = math.Max(box.LatitudeMax, position[1])
+	}
+
+	result := []string{}
+	for _, geohash := range CoverBox(box, length) {
+		cell, _ := Bounds(geohash)
+		if polygonIntersectsBox(polygon, cell) {
+			result = append(result, geohash)
+		}
+	}
+	return result
+}
+
+/**
+ * Circles
+ * distances are great-circle distances on a sphere of EarthRadius.
+ */
+
+// Distance returns the great-circle distance between two coordinates, in
+// metres, with the haversine formula.
+func Distance(latitude1, longitude1, latitude2, longitude2 float64) float64 {
+	lat1 := latitude1 * math.Pi / 180
+	lat2 := latitude2 * math.Pi / 180
+	dLat := lat2 - lat1
+	dLon := (longitude2 - longitude1) * math.Pi / 180
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * EarthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// wrapLongitude returns the longitude in [-180, 180[.
+func wrapLongitude(longitude float64) float64 {
+	longitude = math.Mod(longitude+180, 360)
+	if longitude < 0 {
+		longitude += 360
+	}
+	return longitude - 180
+}
+
+// CircleBox returns the smallest box containing the circle of radius metres
+// around the position.
+func CircleBox(latitude, longitude, radius float64) Box {
+	angle := radius / EarthRadius
+	latitudeMin := math.Max(-90, latitude-angle*180/math.Pi)
+	latitudeMax := math.Min(90, latitude+angle*180/math.Pi)
+
+	// the circle contains a pole, or is too wide, all the longitudes are in
+	cos := math.Cos(latitude * math.Pi / 180)
+	if latitudeMin == -90 || latitudeMax == 90 || math.Sin(angle) >= cos {
+		return Box{latitudeMin, -180, latitudeMax, 180}
+	}
+	longitudeMargin := math.Asin(math.Sin(angle)/cos) * 180 / math.Pi
+	return Box{latitudeMin, wrapLongitude(longitude - longitudeMargin), latitudeMax, wrapLongitude(longitude + longitudeMargin)}
+}
+
+// distanceToCell returns the distance from the position to the closest
+// position of the cell, a box that does not cross the antimeridian.
+func distanceToCell(cell Box, latitude, longitude float64) float64 {
+	if longitude >= cell.LongitudeMin && longitude <= cell.LongitudeMax {
+		return Distance(latitude, longitude, math.Max(cell.LatitudeMin, math.Min(cell.LatitudeMax, latitude)), longitude)
+	}
+
+	// on a parallel the distance grows with the longitude difference, so the
+	// closest position is on one of the meridians of the cell
+	d := math.Inf(1)
+	for _, meridian := range []float64{cell.LongitudeMin, cell.LongitudeMax} {
+		d = math.Min(d, Distance(latitude, longitude, cell.LatitudeMin, meridian))
+		d = math.Min(d, Distance(latitude, longitude, cell.LatitudeMax, meridian))
+
+		delta := math.Abs(wrapLongitude(meridian-longitude)) * math.Pi / 180
+		if delta < math.Pi/2 {
+			closest := math.Atan(math.Tan(latitude*math.Pi/180)/math.Cos(delta)) * 180 / math.Pi
+			if closest > cell.LatitudeMin && closest < cell.LatitudeMax {
+				d = math.Min(d, Distance(latitude, longitude, closest, meridian))
+			}
+		}
+	}
+	return d
+}
+
+// CoverCircle returns the geohashes of the given length whose cells are
+// closer than radius metres to the position.
+func CoverCircle(latitude, longitude, radius float64, length int) []string {
+	result := []string{}
+	for _, geohash := range CoverBox(CircleBox(latitude, longitude, radius), length) {
+		cell, _ := Bounds(geohash)
+		if distanceToCell(cell, latitude, longitude) <= radius {
+			result = append(result, geohash)
+		}
+	}
+	return result
+}
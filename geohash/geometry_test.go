@@ -0,0 +1,208 @@
+package geohash
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBounds(t *testing.T) {
+	tests := []struct {
+		geohash string
+		box     Box
+	}{
+		{"", Box{-90, -180, 90, 180}},
+		{"0", Box{-90, -180, 0, -90}},
+		{"1", Box{0, -180, 90, -90}},
+		{"2", Box{-90, -90, 0, 0}},
+		{"7", Box{0, 90, 90, 180}},
+		{"53", Box{45, 45, 90, 90}},
+	}
+	for _, test := range tests {
+		box, err := Bounds(test.geohash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if box != test.box {
+			t.Errorf("Bounds(%s) = %v, want %v", test.geohash, box, test.box)
+		}
+	}
+
+	for i := 0; i < 1000; i++ {
+		latitude := rand.Float64()*180 - 90
+		longitude := rand.Float64()*360 - 180
+		geohash := GeohashFromCoordinates(latitude, longitude)[:1+rand.Intn(MaxGeohashLength)]
+		box, err := Bounds(geohash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if latitude < box.LatitudeMin || latitude > box.LatitudeMax || longitude < box.LongitudeMin || longitude > box.LongitudeMax {
+			t.Fatalf("%v, %v in %s, outside of its bounds %v", latitude, longitude, geohash, box)
+		}
+	}
+
+	for _, geohash := range []string{"8", "04"} {
+		if _, err := Bounds(geohash); err == nil {
+			t.Errorf("Bounds accepted the wrong geohash %s", geohash)
+		}
+	}
+}
+
+func TestParentAndChildren(t *testing.T) {
+	if parent := Parent("5120"); parent != "512" {
+		t.Errorf("Parent(5120) = %s", parent)
+	}
+	if parent := Parent(""); parent != "" {
+		t.Errorf("Parent() = %s", parent)
+	}
+	if children := Children(""); reflect.DeepEqual(children, []string{"0", "1", "2", "3", "4", "5", "6", "7"}) == false {
+		t.Errorf("Children() = %v", children)
+	}
+	if children := Children("51"); reflect.DeepEqual(children, []string{"510", "511", "512", "513"}) == false {
+		t.Errorf("Children(51) = %v", children)
+	}
+	if children := Children(strings.Repeat("0", MaxGeohashLength)); children != nil {
+		t.Errorf("Children of a geohash of MaxGeohashLength = %v", children)
+	}
+}
+
+func TestNeighbour(t *testing.T) {
+	tests := []struct {
+		geohash   string
+		direction Direction
+		neighbour string
+	}{
+		{"50", North, "51"},
+		{"50", East, "52"},
+		{"50", South, "41"},
+		{"50", West, "32"},
+		{"50", NorthEast, "53"},
+		{"50", SouthWest, "23"},
+		// the longitudes wrap around the antimeridian
+		{"6", East, "0"},
+		{"1", West, "7"},
+		{"7", NorthEast, ""},
+	}
+	for _, test := range tests {
+		neighbour, err := Neighbour(test.geohash, test.direction)
+		if test.neighbour == "" {
+			if err != ErrNoNeighbour {
+				t.Errorf("Neighbour(%s, %d) = %s, %v, want ErrNoNeighbour", test.geohash, test.direction, neighbour, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if neighbour != test.neighbour {
+			t.Errorf("Neighbour(%s, %d) = %s, want %s", test.geohash, test.direction, neighbour, test.neighbour)
+		}
+	}
+
+	// the neighbours are the cells of the surrounding grid, at the lengths
+	// where its offsets are one cell
+	geohash := GeohashFromCoordinates(48.8566, 2.3522)[:13]
+	grid, err := GeohashGridSurroundingGeohash(geohash, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	directions := []Direction{SouthWest, South, SouthEast, West, -1, East, NorthWest, North, NorthEast}
+	for i, direction := range directions {
+		if direction < 0 {
+			continue
+		}
+		if neighbour, err := Neighbour(geohash, direction); err != nil || neighbour != grid[i] {
+			t.Errorf("Neighbour(%s, %d) = %s, %v, want %s", geohash, direction, neighbour, err, grid[i])
+		}
+	}
+}
+
+func TestCoverBox(t *testing.T) {
+	if geohashes := CoverBox(Box{-90, -180, 90, 180}, 0); reflect.DeepEqual(geohashes, []string{""}) == false {
+		t.Errorf("CoverBox of length 0 = %v", geohashes)
+	}
+	// a box crossing the antimeridian
+	if geohashes := CoverBox(Box{10, 170, 20, -170}, 1); reflect.DeepEqual(geohashes, []string{"7", "1"}) == false {
+		t.Errorf("CoverBox across the antimeridian = %v", geohashes)
+	}
+}
+
+func TestCoverPolygon(t *testing.T) {
+	// a triangle with a square hole
+	polygon := [][][]float64{
+		{{2.2, 48.8}, {2.5, 48.8}, {2.35, 48.95}, {2.2, 48.8}},
+		{{2.33, 48.84}, {2.37, 48.84}, {2.37, 48.86}, {2.33, 48.86}, {2.33, 48.84}},
+	}
+	if PolygonContains(polygon, 48.82, 2.35) == false {
+		t.Error("PolygonContains is false inside the polygon")
+	}
+	if PolygonContains(polygon, 48.85, 2.35) {
+		t.Error("PolygonContains is true inside the hole")
+	}
+	if PolygonContains(polygon, 48.93, 2.22) {
+		t.Error("PolygonContains is true outside the polygon")
+	}
+
+	cover := CoverPolygon(polygon, 12)
+	seen := map[string]bool{}
+	for _, geohash := range cover {
+		seen[geohash] = true
+	}
+	if len(cover) >= len(CoverBox(Box{48.8, 2.2, 48.95, 2.5}, 12)) {
+		t.Errorf("CoverPolygon kept all the cells of the bounds, %d cells", len(cover))
+	}
+	for i := 0; i < 10000; i++ {
+		latitude := 48.8 + rand.Float64()*0.15
+		longitude := 2.2 + rand.Float64()*0.3
+		if PolygonContains(polygon, latitude, longitude) == false {
+			continue
+		}
+		if geohash := GeohashFromCoordinates(latitude, longitude)[:12]; seen[geohash] == false {
+			t.Fatalf("%v, %v in %s, not in the cover", latitude, longitude, geohash)
+		}
+	}
+}
+
+func TestCoverCircle(t *testing.T) {
+	circles := []struct {
+		latitude, longitude, radius float64
+		length                      int
+	}{
+		{48.8566, 2.3522, 1000, 14},
+		{64.1466, -21.9426, 50000, 9},
+		{-16.5, 179.9, 20000, 10},
+		{89.9, 0, 30000, 10},
+	}
+	for _, circle := range circles {
+		cover := CoverCircle(circle.latitude, circle.longitude, circle.radius, circle.length)
+		seen := map[string]bool{}
+		for _, geohash := range cover {
+			seen[geohash] = true
+
+			// the cells are close to the position
+			cell, _ := Bounds(geohash)
+			latitude := (cell.LatitudeMin + cell.LatitudeMax) / 2
+			longitude := (cell.LongitudeMin + cell.LongitudeMax) / 2
+			if d := Distance(circle.latitude, circle.longitude, latitude, longitude); d > circle.radius*2 {
+				t.Errorf("CoverCircle(%v) has %s, %v metres away", circle, geohash, d)
+			}
+		}
+
+		box := CircleBox(circle.latitude, circle.longitude, circle.radius)
+		longitudeSpan := box.LongitudeMax - box.LongitudeMin
+		if longitudeSpan < 0 {
+			longitudeSpan += 360
+		}
+		for i := 0; i < 10000; i++ {
+			latitude := box.LatitudeMin + rand.Float64()*(box.LatitudeMax-box.LatitudeMin)
+			longitude := wrapLongitude(box.LongitudeMin + rand.Float64()*longitudeSpan)
+			if Distance(circle.latitude, circle.longitude, latitude, longitude) > circle.radius {
+				continue
+			}
+			if geohash := GeohashFromCoordinates(latitude, longitude)[:circle.length]; seen[geohash] == false {
+				t.Fatalf("%v, %v in %s, not in the cover of %v", latitude, longitude, geohash, circle)
+			}
+		}
+	}
+}
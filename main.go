@@ -66,6 +66,19 @@ func main() {
 	password := config.mustGetString("postgres", "password")
 	services.InitDBConnection(role, password, database, ip)
 
+	if flag.NArg() > 0 {
+		runCommand(flag.Args())
+		return
+	}
+
+	if maxPoints, ok := config.GetInt("parsemap", "supercluster_max_points"); ok {
+		services.SetSuperclusterMaxPoints(maxPoints)
+	}
+
+	if pageSize, ok := config.GetInt("parsemap", "max_points_page_size"); ok {
+		services.SetMaxPointsPageSize(pageSize)
+	}
+
 	api_key := config.mustGetString("parsemap", "api_key")
 	r := gin.New()
 	r.Use(gzip.Gzip(gzip.DefaultCompression))
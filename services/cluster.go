@@ -0,0 +1,120 @@
+package services
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+ * Clustering settings
+ * defaults are stored on the list row, and can be overridden per request
+ */
+
+const (
+	minZoneGeohashLength = 1
+	maxZoneGeohashLength = 17
+
+	maxExpandThreshold = 50
+	maxMaxZonePoints   = 1000
+
+	// the annotations are fetched under at most this many zones
+	maxAnnotationsCoverCells = 1024
+
+	geohashClusterEngine = "geohash"
+	superclusterEngine   = "supercluster"
+)
+
+type clusterSettings struct {
+	// zones with this many points or less are expanded into points
+	ExpandThreshold int `db:"expand_threshold" json:"expand_threshold"`
+
+	// zones with more points are never returned by the zones endpoint
+	MaxZonePoints int `db:"max_zone_points" json:"max_zone_points"`
+
+	MinGeohashLength int `db:"min_geohash_length" json:"min_geohash_length"`
+	MaxGeohashLength int `db:"max_geohash_length" json:"max_geohash_length"`
+
+	// geohash or supercluster
+	Engine string `db:"cluster_engine" json:"cluster_engine"`
+}
+
+func getListClusterSettings(list string) (*clusterSettings, error) {
+	settings := &clusterSettings{}
+	if err := db.Get(settings, "select * from get_list_cluster_settings($1)", list); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// override replaces the list settings with the expandThreshold,
+// maxZonePoints, minGeohashLength, maxGeohashLength and engine request
+// parameters.
+func (s *clusterSettings) override(c *gin.Context) error {
+	if engine := c.Query("engine"); len(engine) > 0 {
+		s.Engine = engine
+	}
+
+	overrides := []struct {
+		param string
+		value *int
+	}{
+		{"expandThreshold", &s.ExpandThreshold},
+		{"maxZonePoints", &s.MaxZonePoints},
+		{"minGeohashLength", &s.MinGeohashLength},
+		{"maxGeohashLength", &s.MaxGeohashLength},
+	}
+	for _, override := range overrides {
+		value := c.Query(override.param)
+		if len(value) == 0 {
+			continue
+		}
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("Wrong value for %s, must be an integer", override.param)
+		}
+		*override.value = v
+	}
+	return s.validate()
+}
+
+func (s *clusterSettings) validate() error {
+	if s.ExpandThreshold < 0 || s.ExpandThreshold > maxExpandThreshold {
+		return fmt.Errorf("expandThreshold must be between 0 and %d", maxExpandThreshold)
+	}
+	if s.MaxZonePoints < 1 || s.MaxZonePoints > maxMaxZonePoints {
+		return fmt.Errorf("maxZonePoints must be between 1 and %d", maxMaxZonePoints)
+	}
+	if s.MinGeohashLength < minZoneGeohashLength || s.MaxGeohashLength > maxZoneGeohashLength || s.MinGeohashLength > s.MaxGeohashLength {
+		return fmt.Errorf("minGeohashLength and maxGeohashLength must be between %d and %d", minZoneGeohashLength, maxZoneGeohashLength)
+	}
+	if s.Engine != geohashClusterEngine && s.Engine != superclusterEngine {
+		return fmt.Errorf("engine must be %s or %s", geohashClusterEngine, superclusterEngine)
+	}
+	return nil
+}
+
+func (s *clusterSettings) clampGeohashLength(geohashLength int) int {
+	if geohashLength > s.MaxGeohashLength {
+		geohashLength = s.MaxGeohashLength
+	} else if geohashLength < s.MinGeohashLength {
+		geohashLength = s.MinGeohashLength
+	}
+	return geohashLength
+}
+
+// boundGeohashLength clamps the geohash length of the annotations, then
+// lowers it until the bounds are covered by at most maxAnnotationsCoverCells
+// zones of the parent length, a deep zoom over wide bounds would enumerate
+// billions of cells.
+func (s *clusterSettings) boundGeohashLength(b bounds, geohashLength int) (int, error) {
+	geohashLength = s.clampGeohashLength(geohashLength)
+	if coverLength := b.coverGeohashLength(0, maxAnnotationsCoverCells); geohashLength-1 > coverLength {
+		geohashLength = coverLength + 1
+	}
+	if geohashLength < s.MinGeohashLength {
+		return 0, fmt.Errorf("The bounds are too large for a geohash length of at least %d, zoom out or narrow the bounds", s.MinGeohashLength)
+	}
+	return geohashLength, nil
+}
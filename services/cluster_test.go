@@ -0,0 +1,42 @@
+package services
+
+import "testing"
+
+func TestBoundGeohashLength(t *testing.T) {
+	settings := &clusterSettings{MinGeohashLength: 1, MaxGeohashLength: 17}
+	tests := []struct {
+		bounds bounds
+		zoom   float64
+	}{
+		// a deep zoom over the world would cover billions of cells
+		{bounds{-85, -180, 85, 180}, 22},
+		{bounds{-85, 170, 85, 160}, 22},
+		{bounds{48.8, 2.2, 48.9, 2.5}, 22},
+		{bounds{48.8, 2.2, 48.9, 2.5}, 12},
+	}
+	for _, test := range tests {
+		requested := settings.clampGeohashLength(geohashLengthForZoom(test.zoom, 0, defaultZoomAnnotationSize))
+		geohashLength, err := settings.boundGeohashLength(test.bounds, requested)
+		if err != nil {
+			t.Fatalf("%v boundGeohashLength(%d): %v", test.bounds, requested, err)
+		}
+		if geohashLength > requested {
+			t.Errorf("%v boundGeohashLength(%d) = %d, longer than requested", test.bounds, requested, geohashLength)
+		}
+		if n := test.bounds.coverCells(geohashLength - 1); n > maxAnnotationsCoverCells {
+			t.Errorf("%v boundGeohashLength(%d) = %d, covered by %v cells", test.bounds, requested, geohashLength, n)
+		}
+		if geohashLength < requested && test.bounds.coverCells(geohashLength) <= maxAnnotationsCoverCells {
+			t.Errorf("%v boundGeohashLength(%d) = %d, a longer length fits", test.bounds, requested, geohashLength)
+		}
+	}
+
+	// the lists can require clusters longer than the bounds allow
+	settings = &clusterSettings{MinGeohashLength: 12, MaxGeohashLength: 17}
+	if _, err := settings.boundGeohashLength(bounds{-85, -180, 85, 180}, 17); err == nil {
+		t.Errorf("boundGeohashLength over the world with a min length of 12 should fail")
+	}
+	if geohashLength, err := settings.boundGeohashLength(bounds{48.8, 2.2, 48.9, 2.5}, 5); err != nil || geohashLength != 12 {
+		t.Errorf("boundGeohashLength(5) with a min length of 12 = %d, %v, want 12", geohashLength, err)
+	}
+}
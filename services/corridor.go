@@ -0,0 +1,341 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/vitaminwater/parsemap/geohash"
+)
+
+/**
+ * Corridor queries
+ * the points within a distance of a route, the candidates are the points of
+ * the geohash cells covering the route.
+ */
+
+const (
+	defaultPolylinePrecision = 5
+
+	maxCorridorBuffer          = 50000
+	maxCorridorVertices        = 10000
+	maxCorridorCoverCells      = 256
+	maxCorridorEnumeratedCells = 65536
+	defaultCorridorLimit       = 500
+	maxCorridorLimit           = 5000
+	corridorPageSize           = 10000
+)
+
+// geoJSONLineStringParams is a GeoJSON LineString geometry, a Feature
+// holding one, or an encoded polyline.
+type geoJSONLineStringParams struct {
+	Type        string                   `json:"type"`
+	Coordinates [][]float64              `json:"coordinates"`
+	Geometry    *geoJSONLineStringParams `json:"geometry"`
+	Polyline    string                   `json:"polyline"`
+}
+
+type fetchListCorridorRequestParams struct {
+	Buffer    float64 `form:"buffer"`
+	Precision int     `form:"precision"`
+	Limit     int     `form:"limit"`
+}
+
+type fetchListCorridorRequest struct {
+	fetchListCorridorRequestParams
+
+	list string
+
+	// [longitude, latitude] positions, as in GeoJSON
+	route [][]float64
+}
+
+type corridorPointModel struct {
+	*fetchPointModel
+
+	// distance to the route, in metres
+	Distance float64 `json:"distance"`
+
+	// distance from the start of the route to the closest position on the
+	// route, in metres
+	DistanceAlong float64 `json:"distance_along"`
+}
+
+type corridorPointsByDistanceAlong []*corridorPointModel
+
+func (p corridorPointsByDistanceAlong) Len() int      { return len(p) }
+func (p corridorPointsByDistanceAlong) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p corridorPointsByDistanceAlong) Less(i, j int) bool {
+	return p[i].DistanceAlong < p[j].DistanceAlong
+}
+
+// decodePolyline decodes an encoded polyline, see
+// https://developers.google.com/maps/documentation/utilities/polylinealgorithm
+func decodePolyline(polyline string, precision int) ([][]float64, error) {
+	factor := math.Pow10(precision)
+	result := [][]float64{}
+	latitude, longitude := 0, 0
+	for i := 0; i < len(polyline); {
+		values := [2]int{}
+		for k := range values {
+			value, shift := 0, uint(0)
+			for {
+				if i >= len(polyline) {
+					return nil, errors.New("Truncated polyline")
+				}
+				b := int(polyline[i]) - 63
+				i++
+				if b < 0 || b > 63 {
+					return nil, errors.New("Wrong polyline character")
+				}
+				value |= (b & 0x1f) << shift
+				shift += 5
+				if b < 0x20 {
+					break
+				}
+			}
+			if value&1 != 0 {
+				values[k] = ^(value >> 1)
+			} else {
+				values[k] = value >> 1
+			}
+		}
+		latitude += values[0]
+		longitude += values[1]
+		result = append(result, []float64{float64(longitude) / factor, float64(latitude) / factor})
+	}
+	return result, nil
+}
+
+// parseRoute returns the positions of the route.
+func parseRoute(line *geoJSONLineStringParams, precision int) ([][]float64, error) {
+	var route [][]float64
+	switch {
+	case len(line.Polyline) > 0:
+		positions, err := decodePolyline(line.Polyline, precision)
+		if err != nil {
+			return nil, err
+		}
+		route = positions
+	case line.Type == "Feature":
+		if line.Geometry == nil {
+			return nil, errors.New("Missing feature geometry")
+		}
+		return parseRoute(line.Geometry, precision)
+	case line.Type == "LineString":
+		route = line.Coordinates
+	default:
+		return nil, fmt.Errorf("Wrong geometry type %s, must be LineString or an encoded polyline", line.Type)
+	}
+
+	if len(route) < 2 {
+		return nil, errors.New("The route must have at least 2 positions")
+	}
+	if len(route) > maxCorridorVertices {
+		return nil, fmt.Errorf("Too many positions, at most %d", maxCorridorVertices)
+	}
+	for _, position := range route {
+		if len(position) < 2 || position[0] < -180 || position[0] > 180 || position[1] < -90 || position[1] > 90 {
+			return nil, errors.New("Wrong route position")
+		}
+	}
+	return route, nil
+}
+
+// longitudeDelta returns the longitude difference from longitude1 to
+// longitude2, going the short way around.
+func longitudeDelta(longitude1, longitude2 float64) float64 {
+	delta := longitude2 - longitude1
+	if delta > 180 {
+		delta -= 360
+	} else if delta < -180 {
+		delta += 360
+	}
+	return delta
+}
+
+// segmentBounds returns the bounds of the segment, grown by buffer metres.
+func segmentBounds(a, b []float64, buffer float64) bounds {
+	metresPerDegree := math.Pi * geohash.EarthRadius / 180
+	latitudeMargin := buffer / metresPerDegree
+	latitudeMin := math.Max(-90, math.Min(a[1], b[1])-latitudeMargin)
+	latitudeMax := math.Min(90, math.Max(a[1], b[1])+latitudeMargin)
+
+	longitudeMargin := 180.0
+	if cos := math.Cos(math.Max(math.Abs(latitudeMin), math.Abs(latitudeMax)) * math.Pi / 180); cos > 1e-6 {
+		longitudeMargin = math.Min(180, latitudeMargin/cos)
+	}
+	delta := longitudeDelta(a[0], b[0])
+	return newBounds(latitudeMin, a[0]+math.Min(0, delta)-longitudeMargin, latitudeMax, a[0]+math.Max(0, delta)+longitudeMargin)
+}
+
+// corridorCover returns the geohash cells covering the route grown by
+// buffer metres, the cells are about as large as the buffer, larger when
+// the route needs too many cells. The cells of the bounds of the segments
+// are enumerated, the geohash length is first lowered until their estimated
+// number is bounded.
+func corridorCover(route [][]float64, buffer float64) []string {
+	latitude := 0.0
+	for _, position := range route {
+		latitude = math.Max(latitude, math.Abs(position[1]))
+	}
+	geohashLength := maxZoneGeohashLength
+	for geohashLength > minZoneGeohashLength && geohashCellSize(geohashLength, latitude) < buffer {
+		geohashLength--
+	}
+
+	segments := make([]bounds, 0, len(route)-1)
+	for i := 1; i < len(route); i++ {
+		segments = append(segments, segmentBounds(route[i-1], route[i], buffer))
+	}
+	for ; geohashLength > minZoneGeohashLength; geohashLength-- {
+		nCells := 0.0
+		for _, segment := range segments {
+			nCells += segment.coverCells(geohashLength)
+		}
+		if nCells <= maxCorridorEnumeratedCells {
+			break
+		}
+	}
+
+	for ; ; geohashLength-- {
+		cover := []string{}
+		seen := map[string]bool{}
+		for i := 0; i < len(segments) && len(cover) <= maxCorridorCoverCells; i++ {
+			for _, hash := range segments[i].geohashes(geohashLength) {
+				if seen[hash] == false {
+					seen[hash] = true
+					cover = append(cover, hash)
+				}
+			}
+		}
+		if len(cover) <= maxCorridorCoverCells || geohashLength <= minZoneGeohashLength {
+			return cover
+		}
+	}
+}
+
+// projectOnRoute returns the distance from the position to the route, and
+// the distance along the route to the closest position on the route.
+func projectOnRoute(route [][]float64, latitude, longitude float64) (float64, float64) {
+	minDistance, distanceAlong := math.Inf(1), 0.0
+	start := 0.0
+	for i := 1; i < len(route); i++ {
+		a, b := route[i-1], route[i]
+
+		// project on the segment in a plane tangent at its start
+		scale := math.Cos(a[1] * math.Pi / 180)
+		bx, by := longitudeDelta(a[0], b[0])*scale, b[1]-a[1]
+		px, py := longitudeDelta(a[0], longitude)*scale, latitude-a[1]
+		t := 0.0
+		if length := bx*bx + by*by; length > 0 {
+			t = math.Max(0, math.Min(1, (px*bx+py*by)/length))
+		}
+
+		closestLatitude := a[1] + t*(b[1]-a[1])
+		closestLongitude := wrapLongitude(a[0] + t*longitudeDelta(a[0], b[0]))
+		segmentLength := geohash.Distance(a[1], a[0], b[1], b[0])
+		if d := geohash.Distance(latitude, longitude, closestLatitude, closestLongitude); d < minDistance {
+			minDistance = d
+			distanceAlong = start + t*segmentLength
+		}
+		start += segmentLength
+	}
+	return minDistance, distanceAlong
+}
+
+// fetchCorridorPoints pages through all the points of the cover, only the
+// request.Limit points closest to the start of the route are kept between
+// the pages.
+func fetchCorridorPoints(request *fetchListCorridorRequest) ([]*corridorPointModel, error) {
+	cover := corridorCover(request.route, request.Buffer)
+	pattern := geohashesPattern(cover)
+
+	result := []*corridorPointModel{}
+	afterDate, afterId := time.Time{}, uint64(0)
+	for {
+		candidates := []*fetchPointModel{}
+		if err := db.Select(&candidates, "select * from get_list_point_page($1, $2, '{}', $3, $4, $5)", request.list, pattern, afterDate, afterId, corridorPageSize); err != nil {
+			return nil, err
+		}
+		for _, point := range candidates {
+			d, along := projectOnRoute(request.route, point.Latitude, point.Longitude)
+			if d <= request.Buffer {
+				result = append(result, &corridorPointModel{point, d, along})
+			}
+		}
+		if len(result) > request.Limit {
+			sort.Stable(corridorPointsByDistanceAlong(result))
+			result = result[:request.Limit]
+		}
+
+		if len(candidates) < corridorPageSize {
+			break
+		}
+		last := candidates[len(candidates)-1]
+		afterDate, afterId = last.DateCreated, last.Id
+	}
+	sort.Stable(corridorPointsByDistanceAlong(result))
+	return result, nil
+}
+
+func fetchListCorridorHandler(c *gin.Context) {
+	request := fetchListCorridorRequest{}
+
+	line := geoJSONLineStringParams{}
+	if err := c.BindWith(&line, binding.JSON); err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusBadRequest)
+		return
+	}
+	if err := c.BindWith(&request.fetchListCorridorRequestParams, binding.Form); err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusBadRequest)
+		return
+	}
+
+	request.list = c.Params.ByName("list")
+
+	if request.Buffer <= 0 || request.Buffer > maxCorridorBuffer {
+		outputJSONErrorCheckType(c.Writer, fmt.Errorf("Wrong buffer, must be between 0 and %d metres", maxCorridorBuffer), http.StatusBadRequest)
+		return
+	}
+	if len(c.Query("precision")) == 0 {
+		request.Precision = defaultPolylinePrecision
+	} else if request.Precision < 1 || request.Precision > 7 {
+		outputJSONErrorCheckType(c.Writer, errors.New("Wrong precision, must be between 1 and 7"), http.StatusBadRequest)
+		return
+	}
+	if request.Limit <= 0 {
+		request.Limit = defaultCorridorLimit
+	} else if request.Limit > maxCorridorLimit {
+		request.Limit = maxCorridorLimit
+	}
+
+	route, err := parseRoute(&line, request.Precision)
+	if err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusBadRequest)
+		return
+	}
+	request.route = route
+
+	corridorPoints, err := fetchCorridorPoints(&request)
+	if err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusInternalServerError)
+		return
+	}
+
+	points := make([]*fetchPointModel, 0, len(corridorPoints))
+	properties := make([]map[string]interface{}, 0, len(corridorPoints))
+	for _, point := range corridorPoints {
+		points = append(points, point.fetchPointModel)
+		properties = append(properties, map[string]interface{}{
+			"distance":       point.Distance,
+			"distance_along": point.DistanceAlong,
+		})
+	}
+	outputPointsWithMetas(c, request.list, points, properties, corridorPoints)
+}
@@ -0,0 +1,142 @@
+package services
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/vitaminwater/parsemap/geohash"
+)
+
+func TestDecodePolyline(t *testing.T) {
+	tests := []struct {
+		polyline  string
+		precision int
+		route     [][]float64
+	}{
+		// the example of the polyline algorithm documentation
+		{"_p~iF~ps|U_ulLnnqC_mqNvxq`@", 5, [][]float64{{-120.2, 38.5}, {-120.95, 40.7}, {-126.453, 43.252}}},
+		{"", 5, [][]float64{}},
+		{"_izlhA~rlgdF_{geC~ywl@_kwzCn`{nI", 6, [][]float64{{-120.2, 38.5}, {-120.95, 40.7}, {-126.453, 43.252}}},
+	}
+	for _, test := range tests {
+		route, err := decodePolyline(test.polyline, test.precision)
+		if err != nil {
+			t.Errorf("decodePolyline(%s) error %s", test.polyline, err)
+			continue
+		}
+		if len(route) != len(test.route) {
+			t.Errorf("decodePolyline(%s) = %v, want %v", test.polyline, route, test.route)
+			continue
+		}
+		for i := range route {
+			if math.Abs(route[i][0]-test.route[i][0]) > 1e-9 || math.Abs(route[i][1]-test.route[i][1]) > 1e-9 {
+				t.Errorf("decodePolyline(%s) = %v, want %v", test.polyline, route, test.route)
+				break
+			}
+		}
+	}
+
+	for _, polyline := range []string{"_p~iF~ps|", "_p~iF~ps|U_ulL", " "} {
+		if _, err := decodePolyline(polyline, 5); err == nil {
+			t.Errorf("decodePolyline(%q) accepted a wrong polyline", polyline)
+		}
+	}
+}
+
+func TestParseRoute(t *testing.T) {
+	tests := []struct {
+		line  geoJSONLineStringParams
+		route [][]float64
+		valid bool
+	}{
+		{geoJSONLineStringParams{Type: "LineString", Coordinates: [][]float64{{2.35, 48.85}, {5.37, 43.29}}}, [][]float64{{2.35, 48.85}, {5.37, 43.29}}, true},
+		{geoJSONLineStringParams{Type: "Feature", Geometry: &geoJSONLineStringParams{Type: "LineString", Coordinates: [][]float64{{2.35, 48.85}, {5.37, 43.29}}}}, [][]float64{{2.35, 48.85}, {5.37, 43.29}}, true},
+		{geoJSONLineStringParams{Polyline: "_p~iF~ps|U_ulLnnqC"}, [][]float64{{-120.2, 38.5}, {-120.95, 40.7}}, true},
+		{geoJSONLineStringParams{Type: "LineString", Coordinates: [][]float64{{2.35, 48.85}}}, nil, false},
+		{geoJSONLineStringParams{Type: "LineString", Coordinates: [][]float64{{2.35, 48.85}, {5.37, 93}}}, nil, false},
+		{geoJSONLineStringParams{Type: "Point"}, nil, false},
+		{geoJSONLineStringParams{Type: "Feature"}, nil, false},
+	}
+	for i, test := range tests {
+		route, err := parseRoute(&test.line, defaultPolylinePrecision)
+		if test.valid == false {
+			if err == nil {
+				t.Errorf("test %d: parseRoute accepted a wrong route", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %d: parseRoute error %s", i, err)
+		} else if reflect.DeepEqual(route, test.route) == false {
+			t.Errorf("test %d: parseRoute = %v, want %v", i, route, test.route)
+		}
+	}
+}
+
+func TestProjectOnRoute(t *testing.T) {
+	// along the equator, a degree of longitude is about 111 km
+	metresPerDegree := math.Pi * geohash.EarthRadius / 180
+	route := [][]float64{{0, 0}, {1, 0}, {1, 1}}
+	tests := []struct {
+		latitude, longitude     float64
+		distance, distanceAlong float64
+	}{
+		{0, 0, 0, 0},
+		{0, 0.5, 0, 0.5 * metresPerDegree},
+		{0.1, 0.5, 0.1 * metresPerDegree, 0.5 * metresPerDegree},
+		{0.5, 1.1, 0.1 * metresPerDegree, 1.5 * metresPerDegree},
+		// before the start of the route
+		{0, -0.2, 0.2 * metresPerDegree, 0},
+		// past the end of the route
+		{1.2, 1, 0.2 * metresPerDegree, 2 * metresPerDegree},
+	}
+	for _, test := range tests {
+		d, along := projectOnRoute(route, test.latitude, test.longitude)
+		if math.Abs(d-test.distance) > 10 || math.Abs(along-test.distanceAlong) > 10 {
+			t.Errorf("projectOnRoute(%v, %v) = %v, %v, want %v, %v", test.latitude, test.longitude, d, along, test.distance, test.distanceAlong)
+		}
+	}
+
+	// a route crossing the antimeridian goes the short way around
+	d, along := projectOnRoute([][]float64{{179.5, 0}, {-179.5, 0}}, 0, 180)
+	if d > 1 || math.Abs(along-0.5*metresPerDegree) > 10 {
+		t.Errorf("projectOnRoute across the antimeridian = %v, %v", d, along)
+	}
+}
+
+func TestCorridorCover(t *testing.T) {
+	tests := []struct {
+		route  [][]float64
+		buffer float64
+	}{
+		{[][]float64{{2.35, 48.85}, {2.36, 48.86}}, 100},
+		// a long route with a small buffer
+		{[][]float64{{2.35, 48.85}, {5.37, 43.29}}, 10},
+		{[][]float64{{-179, -80}, {179, 80}}, maxCorridorBuffer},
+		{[][]float64{{179.9, 10}, {-179.9, 10}}, 1000},
+	}
+	for _, test := range tests {
+		start := time.Now()
+		cover := corridorCover(test.route, test.buffer)
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("corridorCover(%v, %v) took %s", test.route, test.buffer, elapsed)
+		}
+		if len(cover) == 0 || len(cover) > maxCorridorCoverCells {
+			t.Errorf("corridorCover(%v, %v) has %d cells", test.route, test.buffer, len(cover))
+			continue
+		}
+
+		// the positions of the route are in the cover
+		seen := map[string]bool{}
+		for _, hash := range cover {
+			seen[hash] = true
+		}
+		for _, position := range test.route {
+			if hash := geohash.GeohashFromCoordinates(position[1], position[0])[:len(cover[0])]; seen[hash] == false {
+				t.Errorf("corridorCover(%v, %v) misses %v", test.route, test.buffer, position)
+			}
+		}
+	}
+}
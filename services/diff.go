@@ -0,0 +1,184 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/gin-gonic/gin"
+)
+
+/**
+ * Annotation diffs
+ * the annotations sent for a token are kept in memory, a request with the
+ * token only receives the annotations that changed since.
+ * the snapshots are not shared between instances, behind a load balancer
+ * without sticky sessions most tokens are unknown and the responses full.
+ * the clusters are identified by their geohash, two clusters of the
+ * supercluster engine can share one, so all the clusters of a geohash are
+ * sent together.
+ */
+
+const (
+	maxAnnotationSnapshots = 10000
+	annotationSnapshotTTL  = 10 * time.Minute
+)
+
+type annotationSnapshot struct {
+	list    string
+	created time.Time
+
+	// fingerprints of the clusters by geohash, and of the points by identifier
+	clusters map[string]uint32
+	points   map[string]uint32
+}
+
+type fetchMapAnnotationsDiffResults struct {
+	Token string `json:"token"`
+
+	// true when the token is unknown or expired, the response holds all the
+	// annotations
+	Full bool `json:"full"`
+
+	Clusters        []*listZoneModel   `json:"clusters"`
+	Points          []*fetchPointModel `json:"points"`
+	RemovedClusters []string           `json:"removed_clusters"`
+	RemovedPoints   []string           `json:"removed_points"`
+}
+
+var annotationSnapshots = struct {
+	sync.Mutex
+	snapshots map[string]*annotationSnapshot
+
+	// tokens by creation order, the oldest are evicted first
+	tokens []string
+}{snapshots: map[string]*annotationSnapshot{}}
+
+func wantsAnnotationsDiff(c *gin.Context) bool {
+	return c.Query("diff") == "true" || len(c.Query("token")) > 0
+}
+
+// checkAnnotationsDiff returns an error for the requests without diffs, the
+// GeoJSON responses have no room for the token, the hexagons and the merged
+// clusters are not identified by a stable geohash.
+func checkAnnotationsDiff(c *gin.Context, request *fetchMapAnnotationRequest) error {
+	if wantsGeoJSON(c) {
+		return errors.New("diff is not available for GeoJSON responses")
+	}
+	if request.Merge {
+		return errors.New("diff is not available with merge")
+	}
+	if hexMode, _ := wantsHexGrid(c); hexMode {
+		return errors.New("diff is not available with grid=hex")
+	}
+	return nil
+}
+
+func fingerprint(v interface{}) uint32 {
+	h := fnv.New32a()
+	json.NewEncoder(h).Encode(v)
+	return h.Sum32()
+}
+
+func newAnnotationSnapshot(list string, result *fetchMapAnnotationsResults) *annotationSnapshot {
+	snapshot := &annotationSnapshot{
+		list:     list,
+		created:  time.Now(),
+		clusters: map[string]uint32{},
+		points:   map[string]uint32{},
+	}
+	for geohash, zones := range zonesByGeohash(result.Clusters) {
+		snapshot.clusters[geohash] = fingerprint(zones)
+	}
+	for _, point := range result.Points {
+		snapshot.points[point.Identifier] = fingerprint(point)
+	}
+	return snapshot
+}
+
+func zonesByGeohash(zones []*listZoneModel) map[string][]*listZoneModel {
+	result := map[string][]*listZoneModel{}
+	for _, zone := range zones {
+		result[zone.Geohash] = append(result[zone.Geohash], zone)
+	}
+	return result
+}
+
+func storeAnnotationSnapshot(snapshot *annotationSnapshot) string {
+	token := uuid.NewRandom().String()
+
+	annotationSnapshots.Lock()
+	defer annotationSnapshots.Unlock()
+	for len(annotationSnapshots.tokens) > 0 {
+		oldest := annotationSnapshots.snapshots[annotationSnapshots.tokens[0]]
+		if len(annotationSnapshots.tokens) < maxAnnotationSnapshots && time.Since(oldest.created) < annotationSnapshotTTL {
+			break
+		}
+		delete(annotationSnapshots.snapshots, annotationSnapshots.tokens[0])
+		annotationSnapshots.tokens = annotationSnapshots.tokens[1:]
+	}
+	annotationSnapshots.snapshots[token] = snapshot
+	annotationSnapshots.tokens = append(annotationSnapshots.tokens, token)
+	return token
+}
+
+func getAnnotationSnapshot(token, list string) *annotationSnapshot {
+	annotationSnapshots.Lock()
+	defer annotationSnapshots.Unlock()
+	snapshot := annotationSnapshots.snapshots[token]
+	if snapshot == nil || snapshot.list != list || time.Since(snapshot.created) >= annotationSnapshotTTL {
+		return nil
+	}
+	return snapshot
+}
+
+// diffAnnotations returns the annotations of the result that are not in the
+// snapshot of the token, and the ones of the snapshot that are not in the
+// result anymore, all the annotations when the token is unknown.
+func diffAnnotations(list, token string, result *fetchMapAnnotationsResults) *fetchMapAnnotationsDiffResults {
+	previous := getAnnotationSnapshot(token, list)
+	snapshot := newAnnotationSnapshot(list, result)
+	diff := &fetchMapAnnotationsDiffResults{
+		Token:           storeAnnotationSnapshot(snapshot),
+		Clusters:        result.Clusters,
+		Points:          result.Points,
+		RemovedClusters: []string{},
+		RemovedPoints:   []string{},
+	}
+
+	if previous == nil {
+		diff.Full = true
+		return diff
+	}
+
+	diff.Clusters = []*listZoneModel{}
+	for _, zone := range result.Clusters {
+		if f, ok := previous.clusters[zone.Geohash]; ok == false || f != snapshot.clusters[zone.Geohash] {
+			diff.Clusters = append(diff.Clusters, zone)
+		}
+	}
+	for geohash := range previous.clusters {
+		if _, ok := snapshot.clusters[geohash]; ok == false {
+			diff.RemovedClusters = append(diff.RemovedClusters, geohash)
+		}
+	}
+
+	diff.Points = []*fetchPointModel{}
+	for _, point := range result.Points {
+		if f, ok := previous.points[point.Identifier]; ok == false || f != snapshot.points[point.Identifier] {
+			diff.Points = append(diff.Points, point)
+		}
+	}
+	for identifier := range previous.points {
+		if _, ok := snapshot.points[identifier]; ok == false {
+			diff.RemovedPoints = append(diff.RemovedPoints, identifier)
+		}
+	}
+	sort.Strings(diff.RemovedClusters)
+	sort.Strings(diff.RemovedPoints)
+	return diff
+}
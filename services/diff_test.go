@@ -0,0 +1,44 @@
+package services
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffAnnotations(t *testing.T) {
+	result := &fetchMapAnnotationsResults{
+		[]*listZoneModel{newTestZone(8, 10, 2, 2), newTestZone(8, 5, 8, 8)},
+		[]*fetchPointModel{{Identifier: "a", Latitude: 5, Longitude: 5}},
+	}
+
+	// an unknown token gets all the annotations
+	first := diffAnnotations("list", "unknown", result)
+	if first.Full == false || len(first.Clusters) != 2 || len(first.Points) != 1 {
+		t.Fatalf("Unknown token: full %v, %d clusters, %d points, want full with all the annotations", first.Full, len(first.Clusters), len(first.Points))
+	}
+
+	// the tokens are bound to their list
+	if other := diffAnnotations("other", first.Token, result); other.Full == false {
+		t.Errorf("Token of another list: full %v, want true", other.Full)
+	}
+
+	moved := newTestZone(8, 11, 2, 2)
+	next := &fetchMapAnnotationsResults{
+		[]*listZoneModel{moved},
+		[]*fetchPointModel{{Identifier: "a", Latitude: 5, Longitude: 5}, {Identifier: "b", Latitude: 6, Longitude: 6}},
+	}
+	diff := diffAnnotations("list", first.Token, next)
+	if diff.Full {
+		t.Fatalf("Known token: full response")
+	}
+	points := []string{}
+	for _, point := range diff.Points {
+		points = append(points, point.Identifier)
+	}
+	if len(diff.Clusters) != 1 || diff.Clusters[0] != moved || reflect.DeepEqual(points, []string{"b"}) == false {
+		t.Errorf("Diff of %d clusters and points %v, want the changed cluster and b", len(diff.Clusters), points)
+	}
+	if reflect.DeepEqual(diff.RemovedClusters, []string{result.Clusters[1].Geohash}) == false || len(diff.RemovedPoints) != 0 {
+		t.Errorf("Removed clusters %v and points %v, want %s", diff.RemovedClusters, diff.RemovedPoints, result.Clusters[1].Geohash)
+	}
+}
@@ -0,0 +1,83 @@
+package services
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+ * Conditional requests
+ * the validators of a response are the last update of the list and its last
+ * event under the geohashes covered by the response.
+ */
+
+const maxValidatorGeohashes = 64
+
+// the geohashes of the whole list
+var allGeohashes = []string{""}
+
+type listValidatorModel struct {
+	LastUpdate    time.Time `db:"last_update"`
+	LastEventId   int       `db:"last_event_id"`
+	LastEventDate time.Time `db:"last_event_date"`
+}
+
+func (v *listValidatorModel) etag(c *gin.Context) string {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d:%d:%t", v.LastUpdate.UnixNano(), v.LastEventId, wantsGeoJSON(c))
+	// weak, the gzip middleware changes the bytes of the response
+	return fmt.Sprintf("W/\"%x\"", h.Sum64())
+}
+
+func (v *listValidatorModel) lastModified() time.Time {
+	if v.LastEventDate.After(v.LastUpdate) {
+		return v.LastEventDate.UTC()
+	}
+	return v.LastUpdate.UTC()
+}
+
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNotModified sets the ETag and Last-Modified headers of the response,
+// and responds with 304 when the client has the same version, in which case
+// the handler must return.
+func checkNotModified(c *gin.Context, list string, geohashes []string) (bool, error) {
+	validator := listValidatorModel{}
+	query := fmt.Sprintf("select * from get_list_validator($1, '%s')", generateSQLStringArray(geohashes))
+	if err := db.Get(&validator, query, list); err != nil {
+		return false, err
+	}
+
+	etag := validator.etag(c)
+	lastModified := validator.lastModified()
+	c.Header("ETag", etag)
+	c.Header("Last-Modified", lastModified.Format(http.TimeFormat))
+
+	if header := c.Request.Header.Get("If-None-Match"); len(header) > 0 {
+		if etagMatches(header, etag) {
+			c.AbortWithStatus(http.StatusNotModified)
+			return true, nil
+		}
+		return false, nil
+	}
+	if header := c.Request.Header.Get("If-Modified-Since"); len(header) > 0 {
+		if since, err := http.ParseTime(header); err == nil && lastModified.Truncate(time.Second).After(since) == false {
+			c.AbortWithStatus(http.StatusNotModified)
+			return true, nil
+		}
+	}
+	return false, nil
+}
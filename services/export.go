@@ -0,0 +1,356 @@
+package services
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+/**
+ * List export
+ * all the points of a list with their metas, fetched page by page and
+ * written to the response as they come.
+ */
+
+const exportPageSize = 1000
+
+type exportListRequestParams struct {
+	// geojson, csv, kml or gpx, defaults to geojson
+	Format string `form:"format"`
+}
+
+type exportListRequest struct {
+	exportListRequestParams
+
+	list string
+}
+
+// listExporter writes the points of a list in one format, begin and end are
+// called once, writePoints once per page.
+type listExporter interface {
+	begin(w io.Writer, list string) error
+	writePoints(w io.Writer, points []*fetchPointModel) error
+	end(w io.Writer) error
+}
+
+type listExportFormat struct {
+	contentType string
+	extension   string
+	newExporter func() listExporter
+}
+
+var listExportFormats = map[string]*listExportFormat{
+	"geojson": {geoJSONContentType, "geojson", func() listExporter { return &geoJSONListExporter{} }},
+	"csv":     {"text/csv; charset=utf-8", "csv", func() listExporter { return &csvListExporter{} }},
+	"kml":     {"application/vnd.google-earth.kml+xml", "kml", func() listExporter { return &kmlListExporter{} }},
+	"gpx":     {"application/gpx+xml", "gpx", func() listExporter { return &gpxListExporter{} }},
+}
+
+// exportPointMetas returns the metas of the point as a json array.
+func exportPointMetas(point *fetchPointModel) string {
+	metas, err := json.Marshal(geoJSONPointMetas(point))
+	if err != nil {
+		return "[]"
+	}
+	return string(metas)
+}
+
+func formatCoordinate(coordinate float64) string {
+	return strconv.FormatFloat(coordinate, 'f', -1, 64)
+}
+
+/**
+ * GeoJSON, a FeatureCollection written one feature at a time
+ */
+
+type geoJSONListExporter struct {
+	nFeatures int
+}
+
+func (e *geoJSONListExporter) begin(w io.Writer, list string) error {
+	_, err := io.WriteString(w, `{"type":"FeatureCollection","features":[`)
+	return err
+}
+
+func (e *geoJSONListExporter) writePoints(w io.Writer, points []*fetchPointModel) error {
+	fc := newGeoJSONFeatureCollection()
+	fc.addPoints(points)
+	for _, feature := range fc.Features {
+		if e.nFeatures > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		data, err := json.Marshal(feature)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		e.nFeatures++
+	}
+	return nil
+}
+
+func (e *geoJSONListExporter) end(w io.Writer) error {
+	_, err := io.WriteString(w, "]}\n")
+	return err
+}
+
+/**
+ * CSV, the columns of the import and the metas as a json array
+ */
+
+var exportCSVColumns = []string{"identifier", "name", "latitude", "longitude", "provider", "provider_id", "date_created", "metas"}
+
+type csvListExporter struct {
+	writer *csv.Writer
+}
+
+func (e *csvListExporter) begin(w io.Writer, list string) error {
+	e.writer = csv.NewWriter(w)
+	return e.writer.Write(exportCSVColumns)
+}
+
+func (e *csvListExporter) writePoints(w io.Writer, points []*fetchPointModel) error {
+	for _, point := range points {
+		record := []string{
+			point.Identifier,
+			point.Name,
+			formatCoordinate(point.Latitude),
+			formatCoordinate(point.Longitude),
+			point.Provider,
+			point.ProviderId,
+			point.DateCreated.Format(time.RFC3339Nano),
+			exportPointMetas(point),
+		}
+		if err := e.writer.Write(record); err != nil {
+			return err
+		}
+	}
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+func (e *csvListExporter) end(w io.Writer) error {
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+/**
+ * KML, one Placemark per point, the other fields are ExtendedData
+ */
+
+type kmlData struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value"`
+}
+
+type kmlPlacemark struct {
+	XMLName     xml.Name  `xml:"Placemark"`
+	Name        string    `xml:"name"`
+	Data        []kmlData `xml:"ExtendedData>Data"`
+	Coordinates string    `xml:"Point>coordinates"`
+}
+
+type kmlListExporter struct{}
+
+func (e *kmlListExporter) begin(w io.Writer, list string) error {
+	if _, err := io.WriteString(w, xml.Header+`<kml xmlns="http://www.opengis.net/kml/2.2"><Document><name>`); err != nil {
+		return err
+	}
+	if err := xml.EscapeText(w, []byte(list)); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "</name>\n")
+	return err
+}
+
+func (e *kmlListExporter) writePoints(w io.Writer, points []*fetchPointModel) error {
+	encoder := xml.NewEncoder(w)
+	for _, point := range points {
+		placemark := kmlPlacemark{
+			Name: point.Name,
+			Data: []kmlData{
+				{"identifier", point.Identifier},
+				{"provider", point.Provider},
+				{"provider_id", point.ProviderId},
+				{"date_created", point.DateCreated.Format(time.RFC3339Nano)},
+				{"metas", exportPointMetas(point)},
+			},
+			Coordinates: formatCoordinate(point.Longitude) + "," + formatCoordinate(point.Latitude),
+		}
+		if err := encoder.Encode(&placemark); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, "\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *kmlListExporter) end(w io.Writer) error {
+	_, err := io.WriteString(w, "</Document></kml>\n")
+	return err
+}
+
+/**
+ * GPX 1.1, one waypoint per point, the parsemap fields are extensions
+ */
+
+// the parsemap fields are in the namespace of the repository
+type gpxExtensions struct {
+	Identifier string `xml:"https://github.com/vitaminwater/parsemap identifier"`
+	ProviderId string `xml:"https://github.com/vitaminwater/parsemap provider_id"`
+	Metas      string `xml:"https://github.com/vitaminwater/parsemap metas"`
+}
+
+type gpxWaypoint struct {
+	XMLName    xml.Name      `xml:"wpt"`
+	Latitude   string        `xml:"lat,attr"`
+	Longitude  string        `xml:"lon,attr"`
+	Time       string        `xml:"time"`
+	Name       string        `xml:"name"`
+	Source     string        `xml:"src"`
+	Extensions gpxExtensions `xml:"extensions"`
+}
+
+type gpxListExporter struct{}
+
+func (e *gpxListExporter) begin(w io.Writer, list string) error {
+	if _, err := io.WriteString(w, xml.Header+`<gpx version="1.1" creator="parsemap" xmlns="http://www.topografix.com/GPX/1/1"><metadata><name>`); err != nil {
+		return err
+	}
+	if err := xml.EscapeText(w, []byte(list)); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "</name></metadata>\n")
+	return err
+}
+
+func (e *gpxListExporter) writePoints(w io.Writer, points []*fetchPointModel) error {
+	encoder := xml.NewEncoder(w)
+	for _, point := range points {
+		waypoint := gpxWaypoint{
+			Latitude:  formatCoordinate(point.Latitude),
+			Longitude: formatCoordinate(point.Longitude),
+			Time:      point.DateCreated.UTC().Format(time.RFC3339),
+			Name:      point.Name,
+			Source:    point.Provider,
+			Extensions: gpxExtensions{
+				Identifier: point.Identifier,
+				ProviderId: point.ProviderId,
+				Metas:      exportPointMetas(point),
+			},
+		}
+		if err := encoder.Encode(&waypoint); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, "\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *gpxListExporter) end(w io.Writer) error {
+	_, err := io.WriteString(w, "</gpx>\n")
+	return err
+}
+
+/**
+ * Export service
+ */
+
+// fetchExportPage returns the points after the (afterDate, afterId) cursor
+// of get_list_point_page, with their metas.
+func fetchExportPage(list string, afterDate time.Time, afterId uint64) ([]*fetchPointModel, error) {
+	points := []*fetchPointModel{}
+	if err := db.Select(&points, "select * from get_list_point_page($1, '', '{}', $2, $3, $4)", list, afterDate, afterId, exportPageSize); err != nil {
+		return nil, err
+	}
+
+	if err := associateMetasForUnsortedPoints(points, list); err != nil {
+		return nil, err
+	}
+	return points, nil
+}
+
+// exportListPoints writes the points of the list, starting with the first
+// page, the pages are flushed as they are written.
+func exportListPoints(w gin.ResponseWriter, exporter listExporter, list string, points []*fetchPointModel) error {
+	if err := exporter.begin(w, list); err != nil {
+		return err
+	}
+	for {
+		if err := exporter.writePoints(w, points); err != nil {
+			return err
+		}
+		w.Flush()
+
+		if len(points) < exportPageSize {
+			break
+		}
+		last := points[len(points)-1]
+		var err error
+		if points, err = fetchExportPage(list, last.DateCreated, last.Id); err != nil {
+			return err
+		}
+	}
+	return exporter.end(w)
+}
+
+func exportListHandler(c *gin.Context) {
+	request := exportListRequest{}
+
+	if err := c.BindWith(&request.exportListRequestParams, binding.Form); err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusBadRequest)
+		return
+	}
+
+	request.list = c.Params.ByName("list")
+
+	if len(request.Format) == 0 {
+		request.Format = "geojson"
+	}
+	format, ok := listExportFormats[request.Format]
+	if ok == false {
+		outputJSONErrorCheckType(c.Writer, fmt.Errorf("Wrong format %q, must be geojson, csv, kml or gpx", request.Format), http.StatusBadRequest)
+		return
+	}
+
+	if notModified, err := checkNotModified(c, request.list, allGeohashes); err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusInternalServerError)
+		return
+	} else if notModified {
+		return
+	}
+
+	// the first page is fetched before the response starts, its errors can
+	// still be reported
+	points, err := fetchExportPage(request.list, time.Time{}, 0)
+	if err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusInternalServerError)
+		return
+	}
+
+	c.Header("Content-Type", format.contentType)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.%s\"", strings.TrimSpace(request.list), format.extension))
+	c.Writer.WriteHeader(http.StatusOK)
+
+	if err := exportListPoints(c.Writer, format.newExporter(), request.list, points); err != nil {
+		// the response is cut short, the client gets a truncated file
+		fmt.Println(err)
+	}
+}
@@ -0,0 +1,172 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/guregu/null.v2"
+)
+
+/**
+ * GeoJSON output, see RFC 7946
+ */
+
+const geoJSONContentType = "application/geo+json"
+
+type geoJSONGeometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Id         string                 `json:"id,omitempty"`
+	BBox       []float64              `json:"bbox,omitempty"`
+	Geometry   geoJSONGeometry        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoJSONFeatureCollection struct {
+	Type     string            `json:"type"`
+	Features []*geoJSONFeature `json:"features"`
+
+	// pagination of the points endpoint in cursor mode
+	NextCursor string `json:"next_cursor,omitempty"`
+	HasMore    bool   `json:"has_more,omitempty"`
+}
+
+type geoJSONPointMeta struct {
+	Identifier string          `json:"identifier"`
+	Uid        string          `json:"uid"`
+	Action     string          `json:"action"`
+	Content    json.RawMessage `json:"content"`
+	List       null.String     `json:"list"`
+}
+
+func wantsGeoJSON(c *gin.Context) bool {
+	if c.Query("format") == "geojson" {
+		return true
+	}
+	return strings.Contains(c.Request.Header.Get("Accept"), geoJSONContentType)
+}
+
+func newGeoJSONFeatureCollection() *geoJSONFeatureCollection {
+	return &geoJSONFeatureCollection{
+		Type:     "FeatureCollection",
+		Features: []*geoJSONFeature{},
+	}
+}
+
+func newGeoJSONPoint(latitude, longitude float64) geoJSONGeometry {
+	return geoJSONGeometry{"Point", []float64{longitude, latitude}}
+}
+
+func (fc *geoJSONFeatureCollection) addZones(zones []*listZoneModel) {
+	for _, zone := range zones {
+		b := geohashBounds(zone.Geohash)
+		fc.Features = append(fc.Features, &geoJSONFeature{
+			Type:     "Feature",
+			Id:       zone.Geohash,
+			BBox:     []float64{b.longitudeMin, b.latitudeMin, b.longitudeMax, b.latitudeMax},
+			Geometry: newGeoJSONPoint(zone.Latitude, zone.Longitude),
+			Properties: map[string]interface{}{
+				"cluster":        true,
+				"geohash":        zone.Geohash,
+				"n_points":       zone.NPoints,
+				"points_bounds":  zone.PointsBounds,
+				"expansion_zoom": zone.ExpansionZoom,
+			},
+		})
+	}
+}
+
+// geoJSONPointMetas returns the metas of the point with their content as
+// json instead of a json encoded string.
+func geoJSONPointMetas(point *fetchPointModel) []*geoJSONPointMeta {
+	metas := make([]*geoJSONPointMeta, 0, len(point.Metas))
+	for _, meta := range point.Metas {
+		metas = append(metas, &geoJSONPointMeta{meta.Identifier, meta.Uid, meta.Action, json.RawMessage(meta.Content), meta.List})
+	}
+	return metas
+}
+
+func (fc *geoJSONFeatureCollection) addPoints(points []*fetchPointModel) {
+	for _, point := range points {
+		metas := geoJSONPointMetas(point)
+		fc.Features = append(fc.Features, &geoJSONFeature{
+			Type:     "Feature",
+			Id:       point.Identifier,
+			Geometry: newGeoJSONPoint(point.Latitude, point.Longitude),
+			Properties: map[string]interface{}{
+				"cluster":      false,
+				"identifier":   point.Identifier,
+				"name":         point.Name,
+				"provider":     point.Provider,
+				"provider_id":  point.ProviderId,
+				"date_created": point.DateCreated.Format(time.RFC3339Nano),
+				"metas":        metas,
+			},
+		})
+	}
+}
+
+// outputPointsWithMetas associates the metas of the points and writes them,
+// as GeoJSON features with the extra properties of each point when there
+// are some, or as result in JSON.
+func outputPointsWithMetas(c *gin.Context, list string, points []*fetchPointModel, properties []map[string]interface{}, result interface{}) {
+	if err := associateMetasForUnsortedPoints(points, list); err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusInternalServerError)
+		return
+	}
+
+	if wantsGeoJSON(c) {
+		fc := newGeoJSONFeatureCollection()
+		fc.addPoints(points)
+		for i := range properties {
+			for key, value := range properties[i] {
+				fc.Features[i].Properties[key] = value
+			}
+		}
+		outputGeoJSON(c.Writer, http.StatusOK, fc)
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+func (fc *geoJSONFeatureCollection) addHexagons(hexagons []*hexZoneModel) {
+	for _, hexagon := range hexagons {
+		ring := make([][]float64, 0, len(hexagon.Boundary)+1)
+		for _, corner := range hexagon.Boundary {
+			ring = append(ring, []float64{corner.Longitude, corner.Latitude})
+		}
+		ring = append(ring, ring[0])
+		fc.Features = append(fc.Features, &geoJSONFeature{
+			Type:     "Feature",
+			Id:       hexagon.Hex,
+			Geometry: geoJSONGeometry{"Polygon", [][][]float64{ring}},
+			Properties: map[string]interface{}{
+				"hex":        hexagon.Hex,
+				"resolution": hexagon.Resolution,
+				"n_points":   hexagon.NPoints,
+				"latitude":   hexagon.Latitude,
+				"longitude":  hexagon.Longitude,
+			},
+		})
+	}
+}
+
+func outputGeoJSON(w http.ResponseWriter, code int, fc *geoJSONFeatureCollection) {
+	encoder := json.NewEncoder(w)
+
+	w.Header().Set("Content-Type", geoJSONContentType)
+	w.WriteHeader(code)
+	if err := encoder.Encode(fc); err != nil {
+		fmt.Println(err)
+		return
+	}
+}
@@ -0,0 +1,196 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+/**
+ * Heatmap
+ * a regular grid over the viewport, each cell counts the points of the
+ * zones whose average position falls in it.
+ */
+
+const (
+	pngContentType = "image/png"
+
+	defaultHeatmapCellSize = 16
+	maxHeatmapCells        = 65536
+	maxHeatmapFromNodes    = 64
+)
+
+type fetchListHeatmapRequestParams struct {
+	// size of the grid cells, in pixels
+	CellSize float64 `form:"cellSize"`
+}
+
+type fetchListHeatmapRequest struct {
+	fetchMapAnnotationRequest
+	fetchListHeatmapRequestParams
+}
+
+type heatmapModel struct {
+	Columns  int          `json:"columns"`
+	Rows     int          `json:"rows"`
+	CellSize float64      `json:"cell_size"`
+	Bounds   *boundsModel `json:"bounds"`
+	Max      int          `json:"max"`
+
+	// number of points of each cell, row by row from the top left cell
+	Counts []int `json:"counts"`
+}
+
+// newHeatmap returns an empty grid of width x height pixels, the cells are
+// enlarged when the grid would have too many of them.
+func newHeatmap(width, height, cellSize float64, b bounds) *heatmapModel {
+	// the number of cells is checked before the conversions, they overflow
+	// for tiny cells
+	for math.Ceil(width/cellSize)*math.Ceil(height/cellSize) > maxHeatmapCells {
+		cellSize *= 2
+	}
+	columns := int(math.Ceil(width / cellSize))
+	rows := int(math.Ceil(height / cellSize))
+	return &heatmapModel{
+		Columns:  columns,
+		Rows:     rows,
+		CellSize: cellSize,
+		Bounds:   b.model(),
+		Counts:   make([]int, columns*rows),
+	}
+}
+
+func (h *heatmapModel) add(x, y float64, nPoints int) {
+	column := int(math.Floor(x / h.CellSize))
+	row := int(math.Floor(y / h.CellSize))
+	if column < 0 || column >= h.Columns || row < 0 || row >= h.Rows {
+		return
+	}
+	i := row*h.Columns + column
+	h.Counts[i] += nPoints
+	if h.Counts[i] > h.Max {
+		h.Max = h.Counts[i]
+	}
+}
+
+// image returns the grid as a grayscale image, one pixel per cell, the
+// intensity is proportional to the count of the cell.
+func (h *heatmapModel) image() *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, h.Columns, h.Rows))
+	if h.Max == 0 {
+		return img
+	}
+	for i, count := range h.Counts {
+		img.SetGray(i%h.Columns, i/h.Columns, color.Gray{uint8(count * 255 / h.Max)})
+	}
+	return img
+}
+
+func wantsPNG(c *gin.Context) bool {
+	if c.Query("format") == "png" {
+		return true
+	}
+	return strings.Contains(c.Request.Header.Get("Accept"), pngContentType)
+}
+
+func fetchHeatmap(request *fetchListHeatmapRequest) (*heatmapModel, error) {
+	b := request.bounds
+	project := screenProjectionForRequest(&request.fetchMapAnnotationRequest)
+	left, top := project(b.latitudeMax, b.longitudeMin)
+	right, bottom := project(b.latitudeMin, b.longitudeMax)
+	heatmap := newHeatmap(right-left, bottom-top, request.CellSize, b)
+
+	// zones about as wide as the cells
+	cellLongitudeSpan := b.longitudeSpan() / float64(heatmap.Columns)
+	zoneLength := int(math.Ceil(math.Log2(180 / cellLongitudeSpan)))
+	if zoneLength > maxZoneGeohashLength {
+		zoneLength = maxZoneGeohashLength
+	} else if zoneLength < minZoneGeohashLength {
+		zoneLength = minZoneGeohashLength
+	}
+	from_nodes_size := b.coverGeohashLength(0, maxHeatmapFromNodes)
+	if from_nodes_size > zoneLength {
+		from_nodes_size = zoneLength
+	}
+
+	zones := []*listZoneModel{}
+	query := fmt.Sprintf("SELECT * from get_zone_tree_level($1, $2, '%s', $3)", generateSQLStringArray(b.geohashes(from_nodes_size)))
+	if err := db.Select(&zones, query, request.list, zoneLength, from_nodes_size); err != nil {
+		return nil, err
+	}
+
+	for _, zone := range zones {
+		x, y := project(zone.Latitude, zone.Longitude)
+		heatmap.add(x-left, y-top, zone.NPoints)
+	}
+	return heatmap, nil
+}
+
+func fetchListHeatmapHandler(c *gin.Context) {
+	request := fetchListHeatmapRequest{}
+
+	if err := c.BindWith(&request.fetchMapAnnotationRequestParams, binding.Form); err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusBadRequest)
+		return
+	}
+	if err := c.BindWith(&request.fetchListHeatmapRequestParams, binding.Form); err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusBadRequest)
+		return
+	}
+
+	request.list = c.Params.ByName("list")
+	request.zoomMode = len(c.Query("zoom")) > 0
+
+	if allFinite(request.LatitudeMin, request.LongitudeMin, request.LatitudeMax, request.LongitudeMax, request.PixelWidth, request.PixelHeight, request.Zoom, request.CellSize) == false {
+		outputJSONErrorCheckType(c.Writer, errors.New("Wrong viewport, pixel size, zoom or cellSize, must be finite"), http.StatusBadRequest)
+		return
+	}
+	request.bounds = newBounds(request.LatitudeMin, request.LongitudeMin, request.LatitudeMax, request.LongitudeMax)
+
+	if request.zoomMode {
+		if request.Zoom < 0 || request.Zoom > maxZoom {
+			outputJSONErrorCheckType(c.Writer, fmt.Errorf("Wrong zoom level, must be between 0 and %d", maxZoom), http.StatusBadRequest)
+			return
+		}
+	} else if request.PixelWidth <= 0 || request.PixelHeight <= 0 {
+		outputJSONErrorCheckType(c.Writer, errors.New("Missing pixelWidth and pixelHeight, or zoom"), http.StatusBadRequest)
+		return
+	}
+	if request.bounds.latitudeSpan() <= 0 || request.bounds.longitudeSpan() <= 0 {
+		outputJSONErrorCheckType(c.Writer, errors.New("Empty viewport"), http.StatusBadRequest)
+		return
+	}
+	if len(c.Query("cellSize")) == 0 {
+		request.CellSize = defaultHeatmapCellSize
+	} else if request.CellSize < 1 {
+		outputJSONErrorCheckType(c.Writer, errors.New("Wrong cellSize, must be at least 1 pixel"), http.StatusBadRequest)
+		return
+	}
+
+	heatmap, err := fetchHeatmap(&request)
+	if err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusInternalServerError)
+		return
+	}
+
+	if wantsPNG(c) {
+		buffer := bytes.Buffer{}
+		if err := png.Encode(&buffer, heatmap.image()); err != nil {
+			outputJSONErrorCheckType(c.Writer, err, http.StatusInternalServerError)
+			return
+		}
+		c.Data(http.StatusOK, pngContentType, buffer.Bytes())
+		return
+	}
+
+	c.JSON(http.StatusOK, heatmap)
+}
@@ -0,0 +1,269 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+/**
+ * Hexagonal grid
+ * pointy top hexagons laid on the web mercator plane, a hexagon of
+ * resolution n is as wide as a geohash cell of length n, and covers about
+ * four hexagons of resolution n + 1.
+ * the hexagons are aggregated from the zones of the list_zone table.
+ */
+
+const (
+	geohashGrid = "geohash"
+	hexGrid     = "hex"
+
+	// the zones binned into hexagons are hexZoneDepth digits finer than the
+	// hexagons, so that they fall in the right hexagon
+	hexZoneDepth = 2
+
+	defaultHexResolution = 10
+
+	// the zones endpoint bins at most maxHexZones zones, taken from at most
+	// maxHexFromNodes cells covering the viewport
+	maxHexZones     = 65536
+	maxHexFromNodes = 64
+)
+
+type coordinatesModel struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+type hexZoneModel struct {
+	Hex        string  `json:"hex"`
+	Parent     string  `json:"parent,omitempty"`
+	Resolution int     `json:"resolution"`
+	NPoints    int     `json:"n_points"`
+	Latitude   float64 `json:"latitude"`
+	Longitude  float64 `json:"longitude"`
+
+	Boundary []coordinatesModel `json:"boundary"`
+}
+
+type fetchListHexZonesRequestParams struct {
+	// optional viewport, all four are required
+	LatitudeMin  float64 `form:"latitudeMin"`
+	LongitudeMin float64 `form:"longitudeMin"`
+	LatitudeMax  float64 `form:"latitudeMax"`
+	LongitudeMax float64 `form:"longitudeMax"`
+
+	Resolution int `form:"resolution"`
+}
+
+type fetchListHexZonesRequest struct {
+	fetchListHexZonesRequestParams
+
+	list   string
+	bounds bounds
+}
+
+type hexCell struct {
+	resolution int
+	q, r       int
+}
+
+// circumradius of the hexagons of the resolution, in mercator units, they
+// are as wide as the geohash cells of the same length, 180/2^n degrees
+func hexSize(resolution int) float64 {
+	return 1 / (math.Sqrt(3) * math.Exp2(float64(resolution+1)))
+}
+
+// hexCellForCoordinates returns the hexagon containing the coordinates,
+// using axial coordinates, see https://www.redblobgames.com/grids/hexagons/
+func hexCellForCoordinates(latitude, longitude float64, resolution int) hexCell {
+	size := hexSize(resolution)
+	x, y := mercatorX(longitude), mercatorY(latitude)
+
+	q := (math.Sqrt(3)/3*x - y/3) / size
+	r := (2.0 / 3 * y) / size
+
+	// round the cube coordinates, the largest rounding error is recomputed
+	s := -q - r
+	rq, rr, rs := math.Floor(q+0.5), math.Floor(r+0.5), math.Floor(s+0.5)
+	dq, dr, ds := math.Abs(rq-q), math.Abs(rr-r), math.Abs(rs-s)
+	if dq > dr && dq > ds {
+		rq = -rr - rs
+	} else if dr > ds {
+		rr = -rq - rs
+	}
+	return hexCell{resolution, int(rq), int(rr)}
+}
+
+func (h hexCell) id() string {
+	return fmt.Sprintf("%d:%d:%d", h.resolution, h.q, h.r)
+}
+
+func (h hexCell) center() (float64, float64) {
+	size := hexSize(h.resolution)
+	x := size * math.Sqrt(3) * (float64(h.q) + float64(h.r)/2)
+	y := size * 3 / 2 * float64(h.r)
+	return x, y
+}
+
+// parent returns the hexagon of the previous resolution containing the
+// center of this one.
+func (h hexCell) parent() hexCell {
+	x, y := h.center()
+	return hexCellForCoordinates(mercatorLatitude(y), mercatorLongitude(x), h.resolution-1)
+}
+
+// boundary returns the corners of the hexagon, counterclockwise, the
+// mercator y axis points south.
+func (h hexCell) boundary() []coordinatesModel {
+	size := hexSize(h.resolution)
+	x, y := h.center()
+	result := make([]coordinatesModel, 0, 6)
+	for i := 0; i < 6; i++ {
+		angle := math.Pi / 180 * float64(30-60*i)
+		cx, cy := x+size*math.Cos(angle), y+size*math.Sin(angle)
+		result = append(result, coordinatesModel{mercatorLatitude(cy), mercatorLongitude(cx)})
+	}
+	return result
+}
+
+// binZonesToHexagons sums the zones into the hexagons containing their
+// average position.
+func binZonesToHexagons(zones []*listZoneModel, resolution int) []*hexZoneModel {
+	hexagons := map[hexCell]*hexZoneModel{}
+	result := []*hexZoneModel{}
+	for _, zone := range zones {
+		cell := hexCellForCoordinates(zone.Latitude, zone.Longitude, resolution)
+		hexagon, ok := hexagons[cell]
+		if ok == false {
+			hexagon = &hexZoneModel{Hex: cell.id(), Resolution: resolution, Boundary: cell.boundary()}
+			if resolution > 0 {
+				hexagon.Parent = cell.parent().id()
+			}
+			hexagons[cell] = hexagon
+			result = append(result, hexagon)
+		}
+		total := float64(hexagon.NPoints + zone.NPoints)
+		hexagon.Latitude = (hexagon.Latitude*float64(hexagon.NPoints) + zone.Latitude*float64(zone.NPoints)) / total
+		hexagon.Longitude = (hexagon.Longitude*float64(hexagon.NPoints) + zone.Longitude*float64(zone.NPoints)) / total
+		hexagon.NPoints += zone.NPoints
+	}
+	return result
+}
+
+// hexZoneLength returns the geohash length of the zones binned into the
+// hexagons of the resolution.
+func hexZoneLength(resolution int) int {
+	zoneLength := resolution + hexZoneDepth
+	if zoneLength > maxZoneGeohashLength {
+		zoneLength = maxZoneGeohashLength
+	} else if zoneLength < minZoneGeohashLength {
+		zoneLength = minZoneGeohashLength
+	}
+	return zoneLength
+}
+
+// hexFromNodes returns the cells covering the bounds the zones of the
+// hexagons of the resolution are taken from, they are not smaller than the
+// zones.
+func hexFromNodes(b bounds, resolution int) ([]string, int) {
+	from_nodes_size := b.coverGeohashLength(0, maxHexFromNodes)
+	if zoneLength := hexZoneLength(resolution); from_nodes_size > zoneLength {
+		from_nodes_size = zoneLength
+	}
+	return b.geohashes(from_nodes_size), from_nodes_size
+}
+
+// hexZonesCount returns the largest number of zones of the hexagons of the
+// resolution in the bounds.
+func hexZonesCount(b bounds, resolution int) float64 {
+	from_nodes, from_nodes_size := hexFromNodes(b, resolution)
+	return float64(len(from_nodes)) * descendantCells(from_nodes_size, hexZoneLength(resolution))
+}
+
+// fetchListHexZones responds with the hexagons of the list in the viewport,
+// the whole world by default. Without a resolution the default one is
+// lowered until the hexagons have at most maxHexZones zones, a higher
+// resolution is an error.
+func fetchListHexZones(c *gin.Context, list string) {
+	request := fetchListHexZonesRequest{}
+
+	if err := c.BindWith(&request.fetchListHexZonesRequestParams, binding.Form); err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusBadRequest)
+		return
+	}
+
+	request.list = list
+	request.bounds = bounds{-90, -180, 90, 180}
+	if len(c.Query("latitudeMin")) > 0 || len(c.Query("longitudeMin")) > 0 || len(c.Query("latitudeMax")) > 0 || len(c.Query("longitudeMax")) > 0 {
+		if len(c.Query("latitudeMin")) == 0 || len(c.Query("longitudeMin")) == 0 || len(c.Query("latitudeMax")) == 0 || len(c.Query("longitudeMax")) == 0 {
+			outputJSONErrorCheckType(c.Writer, errors.New("Missing latitudeMin, longitudeMin, latitudeMax or longitudeMax"), http.StatusBadRequest)
+			return
+		}
+		if allFinite(request.LatitudeMin, request.LongitudeMin, request.LatitudeMax, request.LongitudeMax) == false {
+			outputJSONErrorCheckType(c.Writer, errors.New("Wrong viewport"), http.StatusBadRequest)
+			return
+		}
+		request.bounds = newBounds(request.LatitudeMin, request.LongitudeMin, request.LatitudeMax, request.LongitudeMax)
+	}
+
+	if len(c.Query("resolution")) == 0 {
+		request.Resolution = defaultHexResolution
+		for request.Resolution > 0 && hexZonesCount(request.bounds, request.Resolution) > maxHexZones {
+			request.Resolution--
+		}
+	} else if request.Resolution < 0 || request.Resolution > maxZoneGeohashLength {
+		outputJSONError(c.Writer, fmt.Sprintf("Wrong resolution, must be between 0 and %d", maxZoneGeohashLength), http.StatusBadRequest)
+		return
+	} else if hexZonesCount(request.bounds, request.Resolution) > maxHexZones {
+		outputJSONError(c.Writer, "Too many hexagons, lower the resolution or narrow the viewport", http.StatusBadRequest)
+		return
+	}
+
+	from_nodes, from_nodes_size := hexFromNodes(request.bounds, request.Resolution)
+	hexagons, err := fetchHexagons(request.list, from_nodes, from_nodes_size, request.Resolution)
+	if err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusInternalServerError)
+		return
+	}
+	outputHexagons(c, hexagons, hexagons)
+}
+
+// fetchHexagons returns the hexagons of the resolution, from_nodes limits
+// the zones to the ones starting with one of its geohashes, a
+// from_nodes_size of 0 takes all the zones of the list.
+func fetchHexagons(list string, from_nodes []string, from_nodes_size int, resolution int) ([]*hexZoneModel, error) {
+	zoneLength := hexZoneLength(resolution)
+	zones := []*listZoneModel{}
+	query := fmt.Sprintf("SELECT * from get_zone_tree_level($1, $2, '%s', $3)", generateSQLStringArray(from_nodes))
+	if err := db.Select(&zones, query, list, zoneLength, from_nodes_size); err != nil {
+		return nil, err
+	}
+	return binZonesToHexagons(zones, resolution), nil
+}
+
+func wantsHexGrid(c *gin.Context) (bool, error) {
+	switch grid := c.Query("grid"); grid {
+	case "", geohashGrid:
+		return false, nil
+	case hexGrid:
+		return true, nil
+	default:
+		return false, fmt.Errorf("grid must be %s or %s", geohashGrid, hexGrid)
+	}
+}
+
+func outputHexagons(c *gin.Context, hexagons []*hexZoneModel, result interface{}) {
+	if wantsGeoJSON(c) {
+		fc := newGeoJSONFeatureCollection()
+		fc.addHexagons(hexagons)
+		outputGeoJSON(c.Writer, http.StatusOK, fc)
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,103 @@
+package services
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestHexCellForCoordinates(t *testing.T) {
+	tests := []struct {
+		latitude, longitude float64
+		resolution          int
+		id                  string
+	}{
+		// the origin of the axial coordinates is the top left of the mercator
+		// plane
+		{maxMercatorLatitude, -180, 0, "0:0:0"},
+		{0, 0, 0, "0:0:1"},
+		{0, 0, 1, "1:1:2"},
+	}
+	for _, test := range tests {
+		if id := hexCellForCoordinates(test.latitude, test.longitude, test.resolution).id(); id != test.id {
+			t.Errorf("hexCellForCoordinates(%v, %v, %d) = %s, want %s", test.latitude, test.longitude, test.resolution, id, test.id)
+		}
+	}
+
+	for i := 0; i < 1000; i++ {
+		latitude := rand.Float64()*170 - 85
+		longitude := rand.Float64()*360 - 180
+		resolution := 1 + rand.Intn(18)
+		cell := hexCellForCoordinates(latitude, longitude, resolution)
+
+		// the position is closer to the center of its hexagon than to the
+		// centers of the neighbours
+		x, y := mercatorX(longitude), mercatorY(latitude)
+		cx, cy := cell.center()
+		d := math.Hypot(x-cx, y-cy)
+		if d > hexSize(resolution)*(1+1e-9) {
+			t.Fatalf("%v, %v is %v from the center of %s, farther than the circumradius", latitude, longitude, d, cell.id())
+		}
+		for _, neighbour := range [][2]int{{1, 0}, {1, -1}, {0, -1}, {-1, 0}, {-1, 1}, {0, 1}} {
+			nx, ny := hexCell{resolution, cell.q + neighbour[0], cell.r + neighbour[1]}.center()
+			if math.Hypot(x-nx, y-ny) < d*(1-1e-9) {
+				t.Fatalf("%v, %v is closer to a neighbour of %s", latitude, longitude, cell.id())
+			}
+		}
+
+		// the center of the hexagon is in the hexagon
+		if center := hexCellForCoordinates(mercatorLatitude(cy), mercatorLongitude(cx), resolution); center != cell {
+			t.Fatalf("The center of %s is in %s", cell.id(), center.id())
+		}
+	}
+}
+
+func TestHexCellBoundary(t *testing.T) {
+	cell := hexCellForCoordinates(48.8566, 2.3522, 10)
+	boundary := cell.boundary()
+	if len(boundary) != 6 {
+		t.Fatalf("%d corners", len(boundary))
+	}
+	cx, cy := cell.center()
+	for _, corner := range boundary {
+		x, y := mercatorX(corner.Longitude), mercatorY(corner.Latitude)
+		if d := math.Hypot(x-cx, y-cy); math.Abs(d-hexSize(10)) > 1e-9 {
+			t.Errorf("Corner %v at %v from the center, want %v", corner, d, hexSize(10))
+		}
+	}
+
+	// the parent contains the center of the hexagon
+	parent := cell.parent()
+	if parent.resolution != 9 || parent != hexCellForCoordinates(mercatorLatitude(cy), mercatorLongitude(cx), 9) {
+		t.Errorf("Parent of %s = %s", cell.id(), parent.id())
+	}
+}
+
+func TestBinZonesToHexagons(t *testing.T) {
+	zones := []*listZoneModel{
+		{Geohash: "a", NPoints: 1, Latitude: 48.8566, Longitude: 2.3522},
+		{Geohash: "b", NPoints: 3, Latitude: 48.8567, Longitude: 2.3526},
+		{Geohash: "c", NPoints: 2, Latitude: -33.8688, Longitude: 151.2093},
+	}
+	hexagons := binZonesToHexagons(zones, 8)
+	if len(hexagons) != 2 {
+		t.Fatalf("%d hexagons, want 2", len(hexagons))
+	}
+
+	tests := []struct {
+		nPoints             int
+		latitude, longitude float64
+	}{
+		{4, (48.8566 + 3*48.8567) / 4, (2.3522 + 3*2.3526) / 4},
+		{2, -33.8688, 151.2093},
+	}
+	for i, test := range tests {
+		hexagon := hexagons[i]
+		if hexagon.NPoints != test.nPoints || math.Abs(hexagon.Latitude-test.latitude) > 1e-9 || math.Abs(hexagon.Longitude-test.longitude) > 1e-9 {
+			t.Errorf("Hexagon %s: %d points at %v, %v, want %d at %v, %v", hexagon.Hex, hexagon.NPoints, hexagon.Latitude, hexagon.Longitude, test.nPoints, test.latitude, test.longitude)
+		}
+		if hexagon.Resolution != 8 || len(hexagon.Parent) == 0 || len(hexagon.Boundary) != 6 {
+			t.Errorf("Hexagon %s: resolution %d, parent %s, %d corners", hexagon.Hex, hexagon.Resolution, hexagon.Parent, len(hexagon.Boundary))
+		}
+	}
+}
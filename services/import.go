@@ -0,0 +1,385 @@
+package services
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/vitaminwater/parsemap/geohash"
+)
+
+/**
+ * Points import
+ * the points are copied into a temporary table, then created and added to
+ * the list by import_list_points, the zones are updated once per geohash
+ * instead of once per point.
+ */
+
+const (
+	importFormatCSV     = "csv"
+	importFormatNDJSON  = "ndjson"
+	importFormatGeoJSON = "geojson"
+
+	maxImportNameLength       = 200
+	maxImportProviderLength   = 100
+	maxImportProviderIdLength = 200
+)
+
+type importListPointsRequestParams struct {
+	// csv, ndjson or geojson, defaults to the format of the content type
+	Format string `form:"format"`
+
+	// provider of the points without one
+	Provider string `form:"provider"`
+
+	NoEvent bool `form:"no_event"`
+}
+
+type importListPointsRequest struct {
+	importListPointsRequestParams
+
+	list    string
+	version string
+	body    io.Reader
+}
+
+type importListPointsResults struct {
+	NPoints int `json:"n_points"`
+}
+
+// importPointModel has the fields of CreatePointRequestParams, a CSV has
+// them as columns, NDJSON as keys and GeoJSON as properties of Point
+// features.
+type importPointModel struct {
+	Name       string  `json:"name"`
+	Latitude   float64 `json:"latitude"`
+	Longitude  float64 `json:"longitude"`
+	Provider   string  `json:"provider"`
+	ProviderId string  `json:"provider_id"`
+}
+
+// importError is an error of the imported content, as opposed to an error
+// of the database.
+type importError struct {
+	// position of the point in the content, 0 for the content itself
+	point int
+	err   error
+}
+
+func (e *importError) Error() string {
+	if e.point == 0 {
+		return e.err.Error()
+	}
+	return fmt.Sprintf("Point %d: %s", e.point, e.err)
+}
+
+type importPointReader interface {
+	// next returns io.EOF after the last point
+	next() (*importPointModel, error)
+}
+
+// ImportFormat returns the import format of the content type, or of the
+// extension of a file name.
+func ImportFormat(contentType string) string {
+	switch {
+	case strings.Contains(contentType, "csv"):
+		return importFormatCSV
+	case strings.Contains(contentType, "ndjson"), strings.HasSuffix(contentType, ".jsonl"):
+		return importFormatNDJSON
+	case strings.Contains(contentType, "json"):
+		return importFormatGeoJSON
+	}
+	return ""
+}
+
+func newImportPointReader(format string, r io.Reader) (importPointReader, error) {
+	switch format {
+	case importFormatCSV:
+		return newCSVImportReader(r)
+	case importFormatNDJSON:
+		return &ndjsonImportReader{json.NewDecoder(r)}, nil
+	case importFormatGeoJSON:
+		return newGeoJSONImportReader(r)
+	}
+	return nil, fmt.Errorf("Wrong format %q, must be %s, %s or %s", format, importFormatCSV, importFormatNDJSON, importFormatGeoJSON)
+}
+
+/**
+ * CSV, with a header row naming the columns
+ */
+
+type csvImportReader struct {
+	reader  *csv.Reader
+	columns map[string]int
+}
+
+func newCSVImportReader(r io.Reader) (*csvImportReader, error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("Missing CSV header")
+	} else if err != nil {
+		return nil, err
+	}
+
+	columns := map[string]int{}
+	for i, column := range header {
+		columns[strings.ToLower(strings.TrimSpace(column))] = i
+	}
+	for _, column := range []string{"name", "latitude", "longitude"} {
+		if _, ok := columns[column]; ok == false {
+			return nil, fmt.Errorf("Missing CSV column %s", column)
+		}
+	}
+	return &csvImportReader{reader, columns}, nil
+}
+
+func (r *csvImportReader) field(record []string, column string) string {
+	if i, ok := r.columns[column]; ok {
+		return strings.TrimSpace(record[i])
+	}
+	return ""
+}
+
+func (r *csvImportReader) next() (*importPointModel, error) {
+	record, err := r.reader.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	point := &importPointModel{
+		Name:       r.field(record, "name"),
+		Provider:   r.field(record, "provider"),
+		ProviderId: r.field(record, "provider_id"),
+	}
+	if point.Latitude, err = strconv.ParseFloat(r.field(record, "latitude"), 64); err != nil {
+		return nil, errors.New("Wrong latitude")
+	}
+	if point.Longitude, err = strconv.ParseFloat(r.field(record, "longitude"), 64); err != nil {
+		return nil, errors.New("Wrong longitude")
+	}
+	return point, nil
+}
+
+/**
+ * NDJSON, one object per line
+ */
+
+type ndjsonImportReader struct {
+	decoder *json.Decoder
+}
+
+func (r *ndjsonImportReader) next() (*importPointModel, error) {
+	point := &importPointModel{}
+	if err := r.decoder.Decode(point); err != nil {
+		return nil, err
+	}
+	return point, nil
+}
+
+/**
+ * GeoJSON FeatureCollection of Point features, decoded one feature at a time
+ */
+
+type geoJSONImportFeature struct {
+	Geometry *struct {
+		Type        string          `json:"type"`
+		Coordinates json.RawMessage `json:"coordinates"`
+	} `json:"geometry"`
+	Properties importPointModel `json:"properties"`
+}
+
+type geoJSONImportReader struct {
+	decoder *json.Decoder
+}
+
+func newGeoJSONImportReader(r io.Reader) (*geoJSONImportReader, error) {
+	decoder := json.NewDecoder(r)
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil, errors.New("Wrong GeoJSON, must be a FeatureCollection")
+	}
+
+	// skip the members before the features
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		if key == "features" {
+			if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+				return nil, errors.New("Wrong GeoJSON features, must be an array")
+			}
+			return &geoJSONImportReader{decoder}, nil
+		}
+		skipped := json.RawMessage{}
+		if err := decoder.Decode(&skipped); err != nil {
+			return nil, err
+		}
+	}
+	return nil, errors.New("Missing GeoJSON features")
+}
+
+func (r *geoJSONImportReader) next() (*importPointModel, error) {
+	if r.decoder.More() == false {
+		return nil, io.EOF
+	}
+
+	feature := geoJSONImportFeature{}
+	if err := r.decoder.Decode(&feature); err != nil {
+		return nil, err
+	}
+	if feature.Geometry == nil || feature.Geometry.Type != "Point" {
+		return nil, errors.New("Wrong geometry, must be a Point")
+	}
+	position := []float64{}
+	if err := json.Unmarshal(feature.Geometry.Coordinates, &position); err != nil || len(position) < 2 {
+		return nil, errors.New("Wrong Point coordinates")
+	}
+	point := &feature.Properties
+	point.Longitude, point.Latitude = position[0], position[1]
+	return point, nil
+}
+
+/**
+ * Import
+ */
+
+func validateImportPoint(point *importPointModel) error {
+	if len(point.Name) == 0 {
+		return errors.New("Missing name")
+	}
+	if len(point.Provider) == 0 {
+		return errors.New("Missing provider")
+	}
+	// NaN passes the comparisons, the coordinates must be finite
+	if allFinite(point.Latitude, point.Longitude) == false || point.Latitude < -90 || point.Latitude > 90 || point.Longitude < -180 || point.Longitude > 180 {
+		return errors.New("Wrong latitude or longitude")
+	}
+	if len([]rune(point.Name)) > maxImportNameLength || len([]rune(point.Provider)) > maxImportProviderLength || len([]rune(point.ProviderId)) > maxImportProviderIdLength {
+		return errors.New("Name, provider or provider_id too long")
+	}
+	return nil
+}
+
+// importListPoints creates the points of the body and adds them to the
+// list, in one transaction, nothing is imported when a point is wrong.
+func importListPoints(request *importListPointsRequest) (int, error) {
+	reader, err := newImportPointReader(request.Format, request.body)
+	if err != nil {
+		return 0, &importError{0, err}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`create temporary table import_point (
+    identifier character(50),
+    geohash character(17),
+    latitude numeric(30,27),
+    longitude numeric(30,27),
+    name character varying(200),
+    provider character varying(100),
+    provider_id character varying(200)
+  ) on commit drop`); err != nil {
+		return 0, err
+	}
+
+	stmt, err := tx.Prepare(pq.CopyIn("import_point", "identifier", "geohash", "latitude", "longitude", "name", "provider", "provider_id"))
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	for i := 1; ; i++ {
+		point, err := reader.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, &importError{i, err}
+		}
+		if len(point.Provider) == 0 {
+			point.Provider = request.Provider
+		}
+		if err := validateImportPoint(point); err != nil {
+			return 0, &importError{i, err}
+		}
+
+		hash := geohash.GeohashFromCoordinates(point.Latitude, point.Longitude)
+		if _, err := stmt.Exec(newUUID(), hash, point.Latitude, point.Longitude, point.Name, point.Provider, point.ProviderId); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := stmt.Exec(); err != nil {
+		return 0, err
+	}
+
+	nPoints := 0
+	if err := tx.QueryRow("select import_list_points($1, $2, $3)", request.list, request.version, request.NoEvent).Scan(&nPoints); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return nPoints, nil
+}
+
+// ImportListPoints imports the points read from r in the format, csv,
+// ndjson or geojson, to the list, used by the import command.
+func ImportListPoints(list, format, provider string, noEvent bool, r io.Reader) (int, error) {
+	request := importListPointsRequest{
+		importListPointsRequestParams: importListPointsRequestParams{
+			Format:   format,
+			Provider: provider,
+			NoEvent:  noEvent,
+		},
+		list:    list,
+		version: apiVersion,
+		body:    r,
+	}
+	return importListPoints(&request)
+}
+
+func importListPointsHandler(c *gin.Context) {
+	request := importListPointsRequest{}
+
+	// the form binding would parse the body when it is sent as a form, the
+	// params are read from the query
+	request.Format = c.Query("format")
+	request.Provider = c.Query("provider")
+	if noEvent := c.Query("no_event"); len(noEvent) > 0 {
+		var err error
+		if request.NoEvent, err = strconv.ParseBool(noEvent); err != nil {
+			outputJSONErrorCheckType(c.Writer, errors.New("Wrong no_event"), http.StatusBadRequest)
+			return
+		}
+	}
+
+	request.list = c.Params.ByName("list")
+	request.version = c.MustGet("version").(string)
+	request.body = c.Request.Body
+
+	if len(request.Format) == 0 {
+		request.Format = ImportFormat(c.Request.Header.Get("Content-Type"))
+	}
+
+	nPoints, err := importListPoints(&request)
+	if _, ok := err.(*importError); ok {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusCreated, &importListPointsResults{nPoints})
+}
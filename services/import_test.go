@@ -0,0 +1,29 @@
+package services
+
+import (
+	"math"
+	"testing"
+)
+
+func TestValidateImportPoint(t *testing.T) {
+	tests := []struct {
+		point importPointModel
+		valid bool
+	}{
+		{importPointModel{Name: "A", Provider: "p", Latitude: 48.85, Longitude: 2.35}, true},
+		{importPointModel{Name: "A", Provider: "p", Latitude: -90, Longitude: 180}, true},
+		{importPointModel{Provider: "p", Latitude: 48.85, Longitude: 2.35}, false},
+		{importPointModel{Name: "A", Latitude: 48.85, Longitude: 2.35}, false},
+		{importPointModel{Name: "A", Provider: "p", Latitude: 91, Longitude: 2.35}, false},
+		{importPointModel{Name: "A", Provider: "p", Latitude: 48.85, Longitude: -181}, false},
+		// "NaN" and "Inf" are parsed by strconv.ParseFloat
+		{importPointModel{Name: "A", Provider: "p", Latitude: math.NaN(), Longitude: 2.35}, false},
+		{importPointModel{Name: "A", Provider: "p", Latitude: 48.85, Longitude: math.NaN()}, false},
+		{importPointModel{Name: "A", Provider: "p", Latitude: math.Inf(1), Longitude: 2.35}, false},
+	}
+	for i, test := range tests {
+		if err := validateImportPoint(&test.point); (err == nil) != test.valid {
+			t.Errorf("test %d: validateImportPoint(%v) = %v, want valid %v", i, test.point, err, test.valid)
+		}
+	}
+}
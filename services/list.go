@@ -1,27 +1,37 @@
 package services
 
 import (
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"math"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
-	"github.com/vitaminwater/geohash"
+	"github.com/vitaminwater/parsemap/geohash"
 	"gopkg.in/guregu/null.v2"
 )
 
-const maxListZoneNPoints int = 200
-
 /**
  * Fetch points from list
  */
 
+// the limit of the points endpoint is capped to maxPointsPageSize
+var maxPointsPageSize = 50
+
+func SetMaxPointsPageSize(pageSize int) {
+	maxPointsPageSize = pageSize
+}
+
 type fetchListPointRequestParams struct {
 	ExcludeGeohash []string `form:"eg[]"`
 	Geohash        string   `form:"geohash" binding:"required"`
 	LastPointDate  string   `form:"last_point_date"`
+	Cursor         string   `form:"cursor"`
 	Limit          int      `form:"limit"`
 }
 
@@ -29,6 +39,47 @@ type fetchListPointRequest struct {
 	fetchListPointRequestParams
 
 	list string
+
+	// cursor mode, the points are paged by (date_created, id)
+	cursorMode bool
+	afterDate  time.Time
+	afterId    uint64
+}
+
+type fetchListPointPageResults struct {
+	Points     []*fetchPointModel `json:"points"`
+	NextCursor string             `json:"next_cursor"`
+	HasMore    bool               `json:"has_more"`
+}
+
+// the cursor is the date_created and id of the last point of the page,
+// an empty cursor starts from the first point.
+func encodePointsCursor(date time.Time, id uint64) string {
+	return base64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("%s,%d", date.Format(time.RFC3339Nano), id)))
+}
+
+func decodePointsCursor(cursor string) (time.Time, uint64, error) {
+	if len(cursor) == 0 {
+		return time.Time{}, 0, nil
+	}
+	wrongCursor := errors.New("Wrong cursor")
+	value, err := base64.URLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, 0, wrongCursor
+	}
+	parts := strings.Split(string(value), ",")
+	if len(parts) != 2 {
+		return time.Time{}, 0, wrongCursor
+	}
+	date, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return time.Time{}, 0, wrongCursor
+	}
+	id, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, wrongCursor
+	}
+	return date, id, nil
 }
 
 func fetchListPointHandler(c *gin.Context) {
@@ -40,9 +91,10 @@ func fetchListPointHandler(c *gin.Context) {
 	}
 
 	request.list = c.Params.ByName("list")
+	_, request.cursorMode = c.Request.URL.Query()["cursor"]
 
-	if request.Limit > 50 {
-		request.Limit = 50
+	if request.Limit > maxPointsPageSize || (request.cursorMode && request.Limit <= 0) {
+		request.Limit = maxPointsPageSize
 	}
 
 	if len(request.Geohash) > geohash.MaxGeohashLength {
@@ -60,10 +112,41 @@ func fetchListPointHandler(c *gin.Context) {
 		}
 	}
 
+	if request.cursorMode {
+		if len(request.LastPointDate) > 0 {
+			outputJSONErrorCheckType(c.Writer, errors.New("The cursor and last_point_date can not be used together"), http.StatusBadRequest)
+			return
+		}
+		date, id, err := decodePointsCursor(request.Cursor)
+		if err != nil {
+			outputJSONErrorCheckType(c.Writer, err, http.StatusBadRequest)
+			return
+		}
+		request.afterDate, request.afterId = date, id
+	}
+
+	// the geohash can also be a similar to pattern
+	validatorGeohashes := allGeohashes
+	if geohash.Valid(request.Geohash) {
+		validatorGeohashes = []string{request.Geohash}
+	}
+	if notModified, err := checkNotModified(c, request.list, validatorGeohashes); err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusInternalServerError)
+		return
+	} else if notModified {
+		return
+	}
+
 	for index, excludeGeohash := range request.ExcludeGeohash {
 		request.ExcludeGeohash[index] = fmt.Sprintf("%s%%", excludeGeohash)
 	}
 	excludeGeohashArray := generateSQLStringArray(request.ExcludeGeohash)
+
+	if request.cursorMode {
+		fetchListPointPage(c, &request, excludeGeohashArray)
+		return
+	}
+
 	query := fmt.Sprintf("select * from get_list_point($1, $2, '%s', $3, $4)", excludeGeohashArray)
 
 	points := []*fetchPointModel{}
@@ -77,9 +160,56 @@ func fetchListPointHandler(c *gin.Context) {
 		return
 	}
 
+	if wantsGeoJSON(c) {
+		fc := newGeoJSONFeatureCollection()
+		fc.addPoints(points)
+		outputGeoJSON(c.Writer, http.StatusOK, fc)
+		return
+	}
+
 	c.JSON(http.StatusOK, points)
 }
 
+func fetchListPointPage(c *gin.Context, request *fetchListPointRequest, excludeGeohashArray string) {
+	// one more point tells whether there is a next page
+	query := fmt.Sprintf("select * from get_list_point_page($1, $2, '%s', $3, $4, $5)", excludeGeohashArray)
+
+	points := []*fetchPointModel{}
+	if err := db.Select(&points, query, request.list, request.Geohash, request.afterDate, request.afterId, request.Limit+1); err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusInternalServerError)
+		return
+	}
+
+	result := fetchListPointPageResults{
+		Points:     points,
+		NextCursor: request.Cursor,
+	}
+	if len(points) > request.Limit {
+		result.Points = points[:request.Limit]
+		result.HasMore = true
+	}
+	if len(result.Points) > 0 {
+		last := result.Points[len(result.Points)-1]
+		result.NextCursor = encodePointsCursor(last.DateCreated, last.Id)
+	}
+
+	if err := associateMetasForUnsortedPoints(result.Points, request.list); err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusInternalServerError)
+		return
+	}
+
+	if wantsGeoJSON(c) {
+		fc := newGeoJSONFeatureCollection()
+		fc.addPoints(result.Points)
+		fc.NextCursor = result.NextCursor
+		fc.HasMore = result.HasMore
+		outputGeoJSON(c.Writer, http.StatusOK, fc)
+		return
+	}
+
+	c.JSON(http.StatusOK, &result)
+}
+
 /**
  * fetch lists for events
  */
@@ -171,8 +301,6 @@ func fetchListMetasForEventsHandler(c *gin.Context) {
 
 /**
  * Get list zones
- * TODO: make configurable from request (maxListZoneNPoints etc...)
- * possibility to provide geohash length
  */
 
 type listZoneModel struct {
@@ -180,19 +308,50 @@ type listZoneModel struct {
 	NPoints   int     `db:"n_points" json:"n_points"`
 	Latitude  float64 `db:"avg_latitude" json:"latitude"`
 	Longitude float64 `db:"avg_longitude" json:"longitude"`
+
+	MinLatitude  float64 `db:"min_latitude" json:"-"`
+	MinLongitude float64 `db:"min_longitude" json:"-"`
+	MaxLatitude  float64 `db:"max_latitude" json:"-"`
+	MaxLongitude float64 `db:"max_longitude" json:"-"`
+
+	Bounds        *boundsModel `json:"bounds"`
+	PointsBounds  *boundsModel `json:"points_bounds"`
+	ExpansionZoom int          `json:"expansion_zoom"`
+
+	// filled when overlapping annotations were merged into this zone
+	MergedGeohashes []string `json:"merged_geohashes,omitempty"`
+	MergedPoints    []string `json:"merged_points,omitempty"`
 }
 
-func cleanupGeohashZonesTree(zones []*listZoneModel) []*listZoneModel {
+// setBounds fills the geohash cell bounds, the bounds of the points in the
+// zone, and the zoom level at which the zone will break apart.
+func (zone *listZoneModel) setBounds() {
+	zone.Bounds = geohashBounds(zone.Geohash).model()
+
+	pointsBounds := bounds{zone.MinLatitude, zone.MinLongitude, zone.MaxLatitude, zone.MaxLongitude}
+	zone.PointsBounds = pointsBounds.model()
+
+	commonLength := len(pointsBounds.commonGeohash())
+	zone.ExpansionZoom = zoomForGeohashLength(commonLength+1, zone.Latitude, defaultZoomAnnotationSize)
+}
+
+func setZonesBounds(zones []*listZoneModel) {
+	for _, zone := range zones {
+		zone.setBounds()
+	}
+}
+
+func cleanupGeohashZonesTree(zones []*listZoneModel, settings *clusterSettings) []*listZoneModel {
 
 	resultArray := make([]*listZoneModel, 0, 200)
 	geohashMap := map[string]bool{}
 
 	for _, zone := range zones {
-		if zone.NPoints > maxListZoneNPoints {
+		if zone.NPoints > settings.MaxZonePoints {
 			continue
 		}
 		canAdd := true
-		for i := len(zone.Geohash) - 1; i >= 5; i-- {
+		for i := len(zone.Geohash) - 1; i >= settings.MinGeohashLength; i-- {
 			if _, ok := geohashMap[zone.Geohash[:i]]; ok == true {
 				canAdd = false
 			}
@@ -208,13 +367,48 @@ func cleanupGeohashZonesTree(zones []*listZoneModel) []*listZoneModel {
 func fetchListGeohashZones(c *gin.Context) {
 	list := c.Params.ByName("list")
 
+	if notModified, err := checkNotModified(c, list, allGeohashes); err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusInternalServerError)
+		return
+	} else if notModified {
+		return
+	}
+
+	settings, err := getListClusterSettings(list)
+	if err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusInternalServerError)
+		return
+	}
+	if err := settings.override(c); err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusBadRequest)
+		return
+	}
+
+	hexMode, err := wantsHexGrid(c)
+	if err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusBadRequest)
+		return
+	}
+	if hexMode {
+		fetchListHexZones(c, list)
+		return
+	}
+
 	zones := []*listZoneModel{}
-	if err := db.Select(&zones, "SELECT * from get_list_geohash_zones($1, $2)", list, maxListZoneNPoints); err != nil {
+	if err := db.Select(&zones, "SELECT * from get_list_geohash_zones($1, $2, $3, $4)", list, settings.MaxZonePoints, settings.MinGeohashLength, settings.MaxGeohashLength); err != nil {
 		outputJSONErrorCheckType(c.Writer, err, http.StatusInternalServerError)
 		return
 	}
 
-	resultArray := cleanupGeohashZonesTree(zones)
+	resultArray := cleanupGeohashZonesTree(zones, settings)
+	setZonesBounds(resultArray)
+
+	if wantsGeoJSON(c) {
+		fc := newGeoJSONFeatureCollection()
+		fc.addZones(resultArray)
+		outputGeoJSON(c.Writer, http.StatusOK, fc)
+		return
+	}
 
 	c.JSON(http.StatusOK, &resultArray)
 }
@@ -228,16 +422,24 @@ type fetchMapAnnotationRequestParams struct {
 	LongitudeMin     float64 `form:"longitudeMin" binding:"required"`
 	LatitudeMax      float64 `form:"latitudeMax" binding:"required"`
 	LongitudeMax     float64 `form:"longitudeMax" binding:"required"`
-	PixelWidth       float64 `form:"pixelWidth" binding:"required"`
-	PixelHeight      float64 `form:"pixelHeight" binding:"required"`
-	AnnotationWidth  float64 `form:"annotationWidth" binding:"required"`
-	AnnotationHeight float64 `form:"annotationHeight" binding:"required"`
+	PixelWidth       float64 `form:"pixelWidth"`
+	PixelHeight      float64 `form:"pixelHeight"`
+	AnnotationWidth  float64 `form:"annotationWidth"`
+	AnnotationHeight float64 `form:"annotationHeight"`
+
+	// zoom mode, replaces the pixel sizes above
+	Zoom float64 `form:"zoom"`
+
+	// merge the overlapping annotations
+	Merge bool `form:"merge"`
 }
 
 type fetchMapAnnotationRequest struct {
 	fetchMapAnnotationRequestParams
 
-	list string
+	list     string
+	zoomMode bool
+	bounds   bounds
 }
 
 type fetchMapAnnotationsResults struct {
@@ -245,22 +447,37 @@ type fetchMapAnnotationsResults struct {
 	Points   []*fetchPointModel `json:"points"`
 }
 
-func fetchMapAnnotations(c *gin.Context) {
-	request := fetchMapAnnotationRequest{}
+type fetchHexagonsResults struct {
+	Hexagons []*hexZoneModel `json:"hexagons"`
+}
 
-	if err := c.BindWith(&request.fetchMapAnnotationRequestParams, binding.Form); err != nil {
-		outputJSONErrorCheckType(c.Writer, err, http.StatusInternalServerError)
-		return
+func geohashLengthForAngle(anglePerAnnotation float64) int {
+	return int(math.Log(180/anglePerAnnotation) / math.Log(2))
+}
+
+func geohashLengthForRequest(request *fetchMapAnnotationRequest) (int, error) {
+	if request.zoomMode {
+		if request.Zoom < 0 || request.Zoom > maxZoom {
+			return 0, fmt.Errorf("Wrong zoom level, must be between 0 and %d", maxZoom)
+		}
+		annotationSize := math.Max(request.AnnotationWidth, request.AnnotationHeight)
+		if annotationSize <= 0 {
+			annotationSize = defaultZoomAnnotationSize
+		}
+		latitude := (request.bounds.latitudeMin + request.bounds.latitudeMax) / 2
+		return geohashLengthForZoom(request.Zoom, latitude, annotationSize), nil
 	}
 
-	request.list = c.Params.ByName("list")
+	if request.PixelWidth <= 0 || request.PixelHeight <= 0 || request.AnnotationWidth <= 0 || request.AnnotationHeight <= 0 {
+		return 0, errors.New("Missing pixelWidth, pixelHeight, annotationWidth or annotationHeight, or zoom")
+	}
 
 	maxHorAnnotations := request.PixelWidth / (request.AnnotationWidth * 2)
 	maxVerAnnotations := request.PixelHeight / (request.AnnotationHeight * 2)
 
 	var anglePerAnnotation float64
-	latDiff := request.LatitudeMax - request.LatitudeMin
-	longDiff := request.LongitudeMax - request.LongitudeMin
+	latDiff := request.bounds.latitudeSpan()
+	longDiff := request.bounds.longitudeSpan()
 
 	maxAnnotations := math.Max(maxHorAnnotations, maxVerAnnotations)
 	if maxHorAnnotations > maxVerAnnotations {
@@ -269,40 +486,245 @@ func fetchMapAnnotations(c *gin.Context) {
 		anglePerAnnotation = latDiff / maxAnnotations
 	}
 
-	geohashLength := int(math.Log(180/anglePerAnnotation) / math.Log(2))
-	if geohashLength > 17 {
-		geohashLength = 17
-	} else if geohashLength < 5 {
-		geohashLength = 5
+	return geohashLengthForAngle(anglePerAnnotation), nil
+}
+
+// zoomLevel returns the web mercator zoom level of the map, computed from
+// the map width when the request is not in zoom mode.
+func (request *fetchMapAnnotationRequest) zoomLevel() float64 {
+	if request.zoomMode {
+		return request.Zoom
 	}
+	return math.Log2(request.PixelWidth * 360 / (request.bounds.longitudeSpan() * mercatorTileSize))
+}
 
-	zones := []*listZoneModel{}
+// annotationsValidatorGeohashes returns the geohashes whose points can be in
+// the annotations of the request, the clusters of the supercluster engine
+// can gather points from anywhere.
+func annotationsValidatorGeohashes(request *fetchMapAnnotationRequest, geohashLength int, settings *clusterSettings) []string {
+	if settings.Engine == superclusterEngine {
+		return allGeohashes
+	}
+	validatorLength := request.bounds.coverGeohashLength(0, maxValidatorGeohashes)
+	if validatorLength > geohashLength-1 {
+		validatorLength = geohashLength - 1
+	}
+	return request.bounds.geohashes(validatorLength)
+}
+
+func fetchAnnotationsInBounds(list string, b bounds, geohashLength int, settings *clusterSettings) (*fetchMapAnnotationsResults, error) {
 	from_nodes_size := geohashLength - 1
-	from_nodes := geohash.CoordinatesBoundsToGeohashes(request.LatitudeMin, request.LongitudeMin, request.LatitudeMax, request.LongitudeMax, from_nodes_size)
+	return fetchAnnotationsInNodes(list, b.geohashes(from_nodes_size), from_nodes_size, geohashLength, settings)
+}
+
+// fetchAnnotationsInNodes returns the zones of the given geohash length under
+// the from_nodes geohashes, zones small enough, or at the finest length of
+// the list, are expanded into points.
+func fetchAnnotationsInNodes(list string, from_nodes []string, from_nodes_size int, geohashLength int, settings *clusterSettings) (*fetchMapAnnotationsResults, error) {
+	zones := []*listZoneModel{}
 	query := fmt.Sprintf("SELECT * from get_zone_tree_level($1, $2, '%s', $3)", generateSQLStringArray(from_nodes))
-	if err := db.Select(&zones, query, request.list, geohashLength, from_nodes_size); err != nil {
-		outputJSONErrorCheckType(c.Writer, err, http.StatusInternalServerError)
-		return
+	if err := db.Select(&zones, query, list, geohashLength, from_nodes_size); err != nil {
+		return nil, err
 	}
 
-	result := fetchMapAnnotationsResults{
+	result := &fetchMapAnnotationsResults{
 		[]*listZoneModel{},
 		[]*fetchPointModel{},
 	}
-	geohashes := "("
+	geohashes := []string{}
 	nPoints := 0
 	for _, zone := range zones {
-		if zone.NPoints <= 4 || geohashLength == 17 {
-			geohashes = fmt.Sprintf("%s%s|", geohashes, zone.Geohash)
+		if zone.NPoints <= settings.ExpandThreshold || geohashLength >= settings.MaxGeohashLength {
+			geohashes = append(geohashes, zone.Geohash)
 			nPoints += zone.NPoints
 		} else {
 			result.Clusters = append(result.Clusters, zone)
 		}
 	}
+	setZonesBounds(result.Clusters)
 
-	if geohashes != "(" {
-		geohashes = geohashes[:len(geohashes)-1] + ")"
-		if err := db.Select(&result.Points, "select * from get_list_point($1, $2, '{}', $3, $4)", request.list, geohashes, time.Time{}, nPoints); err != nil {
+	if len(geohashes) > 0 {
+		if err := db.Select(&result.Points, "select * from get_list_point($1, $2, '{}', $3, $4)", list, geohashesPattern(geohashes), time.Time{}, nPoints); err != nil {
+			return nil, err
+		}
+		if err := associateMetasForPoints(result.Points, list); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func fetchMapAnnotations(c *gin.Context) {
+	request := fetchMapAnnotationRequest{}
+
+	if err := c.BindWith(&request.fetchMapAnnotationRequestParams, binding.Form); err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusInternalServerError)
+		return
+	}
+
+	request.list = c.Params.ByName("list")
+	request.zoomMode = len(c.Query("zoom")) > 0
+	request.bounds = newBounds(request.LatitudeMin, request.LongitudeMin, request.LatitudeMax, request.LongitudeMax)
+
+	if wantsAnnotationsDiff(c) {
+		if err := checkAnnotationsDiff(c, &request); err != nil {
+			outputJSONErrorCheckType(c.Writer, err, http.StatusBadRequest)
+			return
+		}
+	}
+
+	geohashLength, err := geohashLengthForRequest(&request)
+	if err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusBadRequest)
+		return
+	}
+
+	settings, err := getListClusterSettings(request.list)
+	if err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusInternalServerError)
+		return
+	}
+	if err := settings.override(c); err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusBadRequest)
+		return
+	}
+	geohashLength, err = settings.boundGeohashLength(request.bounds, geohashLength)
+	if err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusBadRequest)
+		return
+	}
+
+	// the diffs hold a new token in each response
+	if wantsAnnotationsDiff(c) == false {
+		if notModified, err := checkNotModified(c, request.list, annotationsValidatorGeohashes(&request, geohashLength, settings)); err != nil {
+			outputJSONErrorCheckType(c.Writer, err, http.StatusInternalServerError)
+			return
+		} else if notModified {
+			return
+		}
+	}
+
+	hexMode, err := wantsHexGrid(c)
+	if err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusBadRequest)
+		return
+	}
+	if hexMode {
+		from_nodes_size := geohashLength - 1
+		hexagons, err := fetchHexagons(request.list, request.bounds.geohashes(from_nodes_size), from_nodes_size, geohashLength)
+		if err != nil {
+			outputJSONErrorCheckType(c.Writer, err, http.StatusInternalServerError)
+			return
+		}
+		outputHexagons(c, hexagons, &fetchHexagonsResults{hexagons})
+		return
+	}
+
+	result, err := fetchAnnotations(request.list, request.bounds, request.zoomLevel(), geohashLength, settings)
+	if err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusInternalServerError)
+		return
+	}
+
+	if request.Merge {
+		mergeAnnotations(&request, result)
+	}
+
+	if wantsGeoJSON(c) {
+		fc := newGeoJSONFeatureCollection()
+		fc.addZones(result.Clusters)
+		fc.addPoints(result.Points)
+		outputGeoJSON(c.Writer, http.StatusOK, fc)
+		return
+	}
+
+	if wantsAnnotationsDiff(c) {
+		c.JSON(http.StatusOK, diffAnnotations(request.list, c.Query("token"), result))
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+/**
+ * Cluster drill down
+ */
+
+const (
+	defaultClusterLeavesLimit = 50
+	maxClusterLeavesLimit     = 500
+)
+
+type fetchListClusterRequestParams struct {
+	Leaves bool `form:"leaves"`
+	Limit  int  `form:"limit"`
+	Offset int  `form:"offset"`
+}
+
+type fetchListClusterRequest struct {
+	fetchListClusterRequestParams
+
+	list    string
+	geohash string
+}
+
+type fetchListClusterResults struct {
+	Cluster  *listZoneModel     `json:"cluster"`
+	Clusters []*listZoneModel   `json:"clusters"`
+	Points   []*fetchPointModel `json:"points"`
+}
+
+func validateClusterGeohash(hash string) error {
+	if len(hash) < minZoneGeohashLength || len(hash) > maxZoneGeohashLength || geohash.Valid(hash) == false {
+		return fmt.Errorf("Wrong geohash, must be between %d and %d digits", minZoneGeohashLength, maxZoneGeohashLength)
+	}
+	return nil
+}
+
+func fetchListClusterHandler(c *gin.Context) {
+	request := fetchListClusterRequest{}
+
+	if err := c.BindWith(&request.fetchListClusterRequestParams, binding.Form); err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusBadRequest)
+		return
+	}
+
+	request.list = c.Params.ByName("list")
+	request.geohash = c.Params.ByName("geohash")
+
+	if err := validateClusterGeohash(request.geohash); err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusBadRequest)
+		return
+	}
+
+	if request.Limit <= 0 {
+		request.Limit = defaultClusterLeavesLimit
+	} else if request.Limit > maxClusterLeavesLimit {
+		request.Limit = maxClusterLeavesLimit
+	}
+	if request.Offset < 0 {
+		request.Offset = 0
+	}
+
+	geohashLength := len(request.geohash)
+	geohashArray := generateSQLStringArray([]string{request.geohash})
+
+	zones := []*listZoneModel{}
+	query := fmt.Sprintf("SELECT * from get_zone_tree_level($1, $2, '%s', $3)", geohashArray)
+	if err := db.Select(&zones, query, request.list, geohashLength, geohashLength); err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusInternalServerError)
+		return
+	}
+	if len(zones) == 0 {
+		outputJSONError(c.Writer, "Cluster not found", http.StatusNotFound)
+		return
+	}
+	cluster := zones[0]
+	cluster.setBounds()
+
+	if request.Leaves {
+		result := &fetchListClusterResults{cluster, []*listZoneModel{}, []*fetchPointModel{}}
+		if err := db.Select(&result.Points, "select * from get_list_cluster_points($1, $2, $3, $4)", request.list, request.geohash, request.Limit, request.Offset); err != nil {
 			outputJSONErrorCheckType(c.Writer, err, http.StatusInternalServerError)
 			return
 		}
@@ -310,9 +732,49 @@ func fetchMapAnnotations(c *gin.Context) {
 			outputJSONErrorCheckType(c.Writer, err, http.StatusInternalServerError)
 			return
 		}
+		outputListCluster(c, result)
+		return
 	}
 
-	c.JSON(http.StatusOK, &result)
+	settings, err := getListClusterSettings(request.list)
+	if err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusInternalServerError)
+		return
+	}
+	if err := settings.override(c); err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusBadRequest)
+		return
+	}
+
+	// a small cluster is directly expanded into its points, as the zones at
+	// the finest length of the list
+	childrenLength := geohashLength + 1
+	if cluster.NPoints <= settings.ExpandThreshold || childrenLength > settings.MaxGeohashLength {
+		childrenLength = settings.MaxGeohashLength
+		if childrenLength < geohashLength {
+			childrenLength = geohashLength
+		}
+	}
+
+	children, err := fetchAnnotationsInNodes(request.list, []string{request.geohash}, geohashLength, childrenLength, settings)
+	if err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusInternalServerError)
+		return
+	}
+
+	outputListCluster(c, &fetchListClusterResults{cluster, children.Clusters, children.Points})
+}
+
+func outputListCluster(c *gin.Context, result *fetchListClusterResults) {
+	if wantsGeoJSON(c) {
+		fc := newGeoJSONFeatureCollection()
+		fc.addZones(result.Clusters)
+		fc.addPoints(result.Points)
+		outputGeoJSON(c.Writer, http.StatusOK, fc)
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
 }
 
 /**
@@ -344,6 +806,13 @@ type completeListInfoModel struct {
 func getCompleteListInfoHandler(c *gin.Context) {
 	list := c.Params.ByName("list")
 
+	if notModified, err := checkNotModified(c, list, allGeohashes); err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusInternalServerError)
+		return
+	} else if notModified {
+		return
+	}
+
 	listInfos := completeListInfoModel{}
 	if err := db.Get(&listInfos, "select * from get_complete_list_infos($1)", list); err != nil {
 		outputJSONErrorCheckType(c.Writer, err, http.StatusInternalServerError)
@@ -447,6 +916,13 @@ func createListHandler(c *gin.Context) {
 type updateListRequestParams struct {
 	Name null.String
 	Icon null.String
+
+	ExpandThreshold  null.Int `json:"expand_threshold"`
+	MaxZonePoints    null.Int `json:"max_zone_points"`
+	MinGeohashLength null.Int `json:"min_geohash_length"`
+	MaxGeohashLength null.Int `json:"max_geohash_length"`
+
+	ClusterEngine null.String `json:"cluster_engine"`
 }
 
 type updateListRequest struct {
@@ -456,13 +932,40 @@ type updateListRequest struct {
 }
 
 func updateList(request *updateListRequest) error {
-	_, err := db.Exec("select update_list($1, $2, $3)", request.list, request.Name, request.Icon)
+	_, err := db.Exec("select update_list($1, $2, $3, $4, $5, $6, $7, $8)", request.list, request.Name, request.Icon, request.ExpandThreshold, request.MaxZonePoints, request.MinGeohashLength, request.MaxGeohashLength, request.ClusterEngine)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+func validateListClusterSettings(request *updateListRequest) error {
+	if !request.ExpandThreshold.Valid && !request.MaxZonePoints.Valid && !request.MinGeohashLength.Valid && !request.MaxGeohashLength.Valid && !request.ClusterEngine.Valid {
+		return nil
+	}
+
+	settings, err := getListClusterSettings(request.list)
+	if err != nil {
+		return err
+	}
+	if request.ExpandThreshold.Valid {
+		settings.ExpandThreshold = int(request.ExpandThreshold.Int64)
+	}
+	if request.MaxZonePoints.Valid {
+		settings.MaxZonePoints = int(request.MaxZonePoints.Int64)
+	}
+	if request.MinGeohashLength.Valid {
+		settings.MinGeohashLength = int(request.MinGeohashLength.Int64)
+	}
+	if request.MaxGeohashLength.Valid {
+		settings.MaxGeohashLength = int(request.MaxGeohashLength.Int64)
+	}
+	if request.ClusterEngine.Valid {
+		settings.Engine = request.ClusterEngine.String
+	}
+	return settings.validate()
+}
+
 func updateListHandler(c *gin.Context) {
 	request := updateListRequest{}
 
@@ -473,6 +976,11 @@ func updateListHandler(c *gin.Context) {
 
 	request.list = c.Params.ByName("list")
 
+	if err := validateListClusterSettings(&request); err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusBadRequest)
+		return
+	}
+
 	if err := updateList(&request); err != nil {
 		outputJSONErrorCheckType(c.Writer, err, http.StatusInternalServerError)
 		return
@@ -530,11 +1038,18 @@ func addPointToListHandler(c *gin.Context) {
 		c.Writer.Header().Set("Content-Type", "application/json")
 		c.Writer.WriteHeader(http.StatusCreated)
 	} else {
+		settings, err := getListClusterSettings(request.list)
+		if err != nil {
+			outputJSONErrorCheckType(c.Writer, err, http.StatusInternalServerError)
+			return
+		}
+
 		listZoneModel := listZoneModel{}
-		if err := db.Get(&listZoneModel, "select * from get_list_geohash_zones_for_point($1, $2, $3)", request.list, request.point, maxListZoneNPoints); err != nil {
+		if err := db.Get(&listZoneModel, "select * from get_list_geohash_zones_for_point($1, $2, $3, $4, $5)", request.list, request.point, settings.MaxZonePoints, settings.MinGeohashLength, settings.MaxGeohashLength); err != nil {
 			outputJSONErrorCheckType(c.Writer, err, http.StatusInternalServerError)
 			return
 		}
+		listZoneModel.setBounds()
 
 		c.JSON(http.StatusCreated, &listZoneModel)
 	}
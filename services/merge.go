@@ -0,0 +1,247 @@
+package services
+
+import (
+	"math"
+	"sort"
+)
+
+/**
+ * Cluster merging
+ * the clusters are made on a fixed geohash grid, two groups on either side
+ * of a cell boundary end up as two overlapping annotations, merge them, and
+ * group the points overlapping each other into new clusters.
+ */
+
+// screenProjection returns the position of coordinates on the map, in pixels.
+type screenProjection func(latitude, longitude float64) (float64, float64)
+
+func screenProjectionForRequest(request *fetchMapAnnotationRequest) screenProjection {
+	b := request.bounds
+	if request.zoomMode {
+		worldSize := mercatorTileSize * math.Exp2(request.Zoom)
+		xMin := mercatorX(b.longitudeMin)
+		return func(latitude, longitude float64) (float64, float64) {
+			x := mercatorX(longitude) - xMin
+			if x < 0 {
+				x += 1
+			}
+			return x * worldSize, mercatorY(latitude) * worldSize
+		}
+	}
+
+	pixelsPerLongitude := request.PixelWidth / b.longitudeSpan()
+	pixelsPerLatitude := request.PixelHeight / b.latitudeSpan()
+	return func(latitude, longitude float64) (float64, float64) {
+		x := longitude - b.longitudeMin
+		if x < 0 {
+			x += 360
+		}
+		return x * pixelsPerLongitude, (b.latitudeMax - latitude) * pixelsPerLatitude
+	}
+}
+
+func mergeAnnotations(request *fetchMapAnnotationRequest, result *fetchMapAnnotationsResults) {
+	m := &annotationMerger{
+		project:          screenProjectionForRequest(request),
+		zoom:             request.zoomLevel(),
+		annotationWidth:  request.AnnotationWidth,
+		annotationHeight: request.AnnotationHeight,
+	}
+	if m.annotationWidth <= 0 {
+		m.annotationWidth = defaultZoomAnnotationSize
+	}
+	if m.annotationHeight <= 0 {
+		m.annotationHeight = defaultZoomAnnotationSize
+	}
+	m.merge(result)
+}
+
+type annotationMerger struct {
+	project          screenProjection
+	zoom             float64
+	annotationWidth  float64
+	annotationHeight float64
+}
+
+func (m *annotationMerger) overlaps(latitude1, longitude1, latitude2, longitude2 float64) bool {
+	x1, y1 := m.project(latitude1, longitude1)
+	x2, y2 := m.project(latitude2, longitude2)
+	return math.Abs(x1-x2) < m.annotationWidth && math.Abs(y1-y2) < m.annotationHeight
+}
+
+// absorb adds nPoints points around latitude/longitude to the zone, the zone
+// position stays the average of all its points.
+func (zone *listZoneModel) absorb(nPoints int, latitude, longitude, minLatitude, minLongitude, maxLatitude, maxLongitude float64) {
+	total := float64(zone.NPoints + nPoints)
+	zone.Latitude = (zone.Latitude*float64(zone.NPoints) + latitude*float64(nPoints)) / total
+	zone.Longitude = (zone.Longitude*float64(zone.NPoints) + longitude*float64(nPoints)) / total
+	zone.NPoints += nPoints
+
+	zone.MinLatitude = math.Min(zone.MinLatitude, minLatitude)
+	zone.MinLongitude = math.Min(zone.MinLongitude, minLongitude)
+	zone.MaxLatitude = math.Max(zone.MaxLatitude, maxLatitude)
+	zone.MaxLongitude = math.Max(zone.MaxLongitude, maxLongitude)
+}
+
+// setMergedBounds sets the bounds of the zone to the union of its cell, of
+// the cells of the zones it absorbed, and of its points.
+func (zone *listZoneModel) setMergedBounds() {
+	b := geohashBounds(zone.Geohash)
+	cells := []bounds{{zone.MinLatitude, zone.MinLongitude, zone.MaxLatitude, zone.MaxLongitude}}
+	for _, hash := range zone.MergedGeohashes {
+		cells = append(cells, geohashBounds(hash))
+	}
+	for _, cell := range cells {
+		b.latitudeMin = math.Min(b.latitudeMin, cell.latitudeMin)
+		b.longitudeMin = math.Min(b.longitudeMin, cell.longitudeMin)
+		b.latitudeMax = math.Max(b.latitudeMax, cell.latitudeMax)
+		b.longitudeMax = math.Max(b.longitudeMax, cell.longitudeMax)
+	}
+	zone.Bounds = b.model()
+}
+
+type zonesByNPoints []*listZoneModel
+
+func (z zonesByNPoints) Len() int           { return len(z) }
+func (z zonesByNPoints) Swap(i, j int)      { z[i], z[j] = z[j], z[i] }
+func (z zonesByNPoints) Less(i, j int) bool { return z[i].NPoints > z[j].NPoints }
+
+// merge combines the overlapping clusters, the biggest clusters absorb the
+// smaller ones, then the points overlapping a cluster are absorbed by it,
+// and the remaining points overlapping each other become new clusters.
+func (m *annotationMerger) merge(result *fetchMapAnnotationsResults) {
+	clusters := make([]*listZoneModel, len(result.Clusters))
+	copy(clusters, result.Clusters)
+	sort.Sort(zonesByNPoints(clusters))
+
+	merged := []*listZoneModel{}
+	absorbed := make([]bool, len(clusters))
+	for i, zone := range clusters {
+		if absorbed[i] {
+			continue
+		}
+		// absorbing a cluster moves the zone, loop until nothing overlaps anymore
+		for changed := true; changed; {
+			changed = false
+			for j := i + 1; j < len(clusters); j++ {
+				other := clusters[j]
+				if absorbed[j] || m.overlaps(zone.Latitude, zone.Longitude, other.Latitude, other.Longitude) == false {
+					continue
+				}
+				zone.absorb(other.NPoints, other.Latitude, other.Longitude, other.MinLatitude, other.MinLongitude, other.MaxLatitude, other.MaxLongitude)
+				if other.ExpansionZoom > 0 && (zone.ExpansionZoom == 0 || other.ExpansionZoom < zone.ExpansionZoom) {
+					zone.ExpansionZoom = other.ExpansionZoom
+				}
+				zone.MergedGeohashes = append(zone.MergedGeohashes, other.Geohash)
+				zone.MergedGeohashes = append(zone.MergedGeohashes, other.MergedGeohashes...)
+				absorbed[j] = true
+				changed = true
+			}
+		}
+		merged = append(merged, zone)
+	}
+
+	points := []*fetchPointModel{}
+	for _, point := range result.Points {
+		var closest *listZoneModel
+		closestDistance := math.Inf(1)
+		px, py := m.project(point.Latitude, point.Longitude)
+		for _, zone := range merged {
+			if m.overlaps(zone.Latitude, zone.Longitude, point.Latitude, point.Longitude) == false {
+				continue
+			}
+			zx, zy := m.project(zone.Latitude, zone.Longitude)
+			if distance := math.Hypot(px-zx, py-zy); distance < closestDistance {
+				closest = zone
+				closestDistance = distance
+			}
+		}
+		if closest == nil {
+			points = append(points, point)
+			continue
+		}
+		closest.absorb(1, point.Latitude, point.Longitude, point.Latitude, point.Longitude, point.Latitude, point.Longitude)
+		closest.MergedPoints = append(closest.MergedPoints, point.Identifier)
+	}
+
+	pointClusters, points := m.mergePoints(points)
+	merged = append(merged, pointClusters...)
+
+	for _, zone := range merged {
+		// the smallest expansion zoom of the absorbed clusters, the one set
+		// by the engine for the zones left alone
+		membersZoom := zone.ExpansionZoom
+		zone.setBounds()
+		if len(zone.MergedGeohashes) == 0 && len(zone.MergedPoints) == 0 {
+			if membersZoom > 0 {
+				zone.ExpansionZoom = membersZoom
+			}
+			continue
+		}
+		zone.setMergedBounds()
+		zone.ExpansionZoom = m.expansionZoom(membersZoom, zone.ExpansionZoom)
+	}
+	result.Clusters = merged
+	result.Points = points
+}
+
+// expansionZoom returns the zoom level at which a merged zone breaks apart,
+// the smallest expansion zoom of its clusters, or the one of its points
+// bounds when it was made of points only. The common geohash of bounds
+// straddling the equator or the meridian 0 is short, a merged zone always
+// expands at a deeper zoom than the map.
+func (m *annotationMerger) expansionZoom(membersZoom, pointsZoom int) int {
+	expansionZoom := membersZoom
+	if expansionZoom == 0 {
+		expansionZoom = pointsZoom
+	}
+	if minZoom := int(math.Floor(m.zoom)) + 1; expansionZoom < minZoom {
+		expansionZoom = minZoom
+	}
+	return expansionZoom
+}
+
+// mergePoints groups the points overlapping each other into new clusters,
+// whose geohash is the smallest cell containing their points, and returns
+// them with the points left alone.
+func (m *annotationMerger) mergePoints(points []*fetchPointModel) ([]*listZoneModel, []*fetchPointModel) {
+	clusters := []*listZoneModel{}
+	remaining := []*fetchPointModel{}
+	absorbed := make([]bool, len(points))
+	for i, point := range points {
+		if absorbed[i] {
+			continue
+		}
+		zone := &listZoneModel{
+			NPoints:      1,
+			Latitude:     point.Latitude,
+			Longitude:    point.Longitude,
+			MinLatitude:  point.Latitude,
+			MinLongitude: point.Longitude,
+			MaxLatitude:  point.Latitude,
+			MaxLongitude: point.Longitude,
+			MergedPoints: []string{point.Identifier},
+		}
+		// absorbing a point moves the zone, loop until nothing overlaps anymore
+		for changed := true; changed; {
+			changed = false
+			for j := i + 1; j < len(points); j++ {
+				other := points[j]
+				if absorbed[j] || m.overlaps(zone.Latitude, zone.Longitude, other.Latitude, other.Longitude) == false {
+					continue
+				}
+				zone.absorb(1, other.Latitude, other.Longitude, other.Latitude, other.Longitude, other.Latitude, other.Longitude)
+				zone.MergedPoints = append(zone.MergedPoints, other.Identifier)
+				absorbed[j] = true
+				changed = true
+			}
+		}
+		if zone.NPoints == 1 {
+			remaining = append(remaining, point)
+			continue
+		}
+		zone.Geohash = bounds{zone.MinLatitude, zone.MinLongitude, zone.MaxLatitude, zone.MaxLongitude}.commonGeohash()
+		clusters = append(clusters, zone)
+	}
+	return clusters, remaining
+}
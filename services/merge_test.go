@@ -0,0 +1,202 @@
+package services
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/vitaminwater/parsemap/geohash"
+)
+
+func newTestZone(geohashLength, nPoints int, latitude, longitude float64) *listZoneModel {
+	return &listZoneModel{
+		Geohash:      geohash.GeohashFromCoordinates(latitude, longitude)[:geohashLength],
+		NPoints:      nPoints,
+		Latitude:     latitude,
+		Longitude:    longitude,
+		MinLatitude:  latitude,
+		MinLongitude: longitude,
+		MaxLatitude:  latitude,
+		MaxLongitude: longitude,
+	}
+}
+
+func TestMergeAnnotations(t *testing.T) {
+	// 100 pixels per degree, the annotations are 0.4 degree wide
+	request := &fetchMapAnnotationRequest{
+		fetchMapAnnotationRequestParams: fetchMapAnnotationRequestParams{
+			PixelWidth:  1000,
+			PixelHeight: 1000,
+		},
+		bounds: bounds{0, 0, 10, 10},
+	}
+
+	tests := []struct {
+		name     string
+		clusters []*listZoneModel
+		points   []*fetchPointModel
+
+		// n_points of the clusters, and identifiers of the points left
+		nPoints      []int
+		leftPoints   []string
+		mergedPoints [][]string
+	}{
+		{
+			name:         "distant annotations",
+			clusters:     []*listZoneModel{newTestZone(8, 10, 2, 2), newTestZone(8, 5, 8, 8)},
+			points:       []*fetchPointModel{{Identifier: "a", Latitude: 5, Longitude: 5}},
+			nPoints:      []int{10, 5},
+			leftPoints:   []string{"a"},
+			mergedPoints: [][]string{nil, nil},
+		},
+		{
+			name:         "overlapping clusters",
+			clusters:     []*listZoneModel{newTestZone(8, 5, 2.1, 2.1), newTestZone(8, 10, 2, 2)},
+			nPoints:      []int{15},
+			leftPoints:   []string{},
+			mergedPoints: [][]string{nil},
+		},
+		{
+			name:         "point overlapping a cluster",
+			clusters:     []*listZoneModel{newTestZone(8, 10, 2, 2)},
+			points:       []*fetchPointModel{{Identifier: "a", Latitude: 2.2, Longitude: 2.2}, {Identifier: "b", Latitude: 5, Longitude: 5}},
+			nPoints:      []int{11},
+			leftPoints:   []string{"b"},
+			mergedPoints: [][]string{{"a"}},
+		},
+		{
+			name: "overlapping points",
+			points: []*fetchPointModel{
+				{Identifier: "a", Latitude: 5, Longitude: 5},
+				{Identifier: "b", Latitude: 5.1, Longitude: 5.1},
+				{Identifier: "c", Latitude: 5.3, Longitude: 5.3},
+				{Identifier: "d", Latitude: 8, Longitude: 8},
+			},
+			nPoints:      []int{3},
+			leftPoints:   []string{"d"},
+			mergedPoints: [][]string{{"a", "b", "c"}},
+		},
+	}
+	for _, test := range tests {
+		result := &fetchMapAnnotationsResults{test.clusters, test.points}
+		if result.Clusters == nil {
+			result.Clusters = []*listZoneModel{}
+		}
+		// the cells of the clusters before merging
+		cells := []bounds{}
+		for _, zone := range result.Clusters {
+			cells = append(cells, geohashBounds(zone.Geohash))
+		}
+
+		mergeAnnotations(request, result)
+
+		nPoints := []int{}
+		mergedPoints := [][]string{}
+		for _, zone := range result.Clusters {
+			nPoints = append(nPoints, zone.NPoints)
+			mergedPoints = append(mergedPoints, zone.MergedPoints)
+		}
+		points := []string{}
+		for _, point := range result.Points {
+			points = append(points, point.Identifier)
+		}
+		if reflect.DeepEqual(nPoints, test.nPoints) == false || reflect.DeepEqual(points, test.leftPoints) == false || reflect.DeepEqual(mergedPoints, test.mergedPoints) == false {
+			t.Errorf("%s: clusters of %v points with %v, points %v, want %v with %v, %v", test.name, nPoints, mergedPoints, points, test.nPoints, test.mergedPoints, test.leftPoints)
+			continue
+		}
+
+		for _, zone := range result.Clusters {
+			if zone.Bounds == nil || zone.PointsBounds == nil {
+				t.Errorf("%s: zone %s without bounds", test.name, zone.Geohash)
+				continue
+			}
+			// the bounds cover the cells of the merged clusters and the points
+			b := zone.Bounds
+			for _, cell := range cells {
+				if len(zone.MergedGeohashes) == 0 {
+					break
+				}
+				if cell.latitudeMin < b.LatitudeMin || cell.longitudeMin < b.LongitudeMin || cell.latitudeMax > b.LatitudeMax || cell.longitudeMax > b.LongitudeMax {
+					t.Errorf("%s: bounds %v of %s do not cover the cell %v", test.name, *b, zone.Geohash, cell)
+				}
+			}
+			p := zone.PointsBounds
+			if p.LatitudeMin < b.LatitudeMin || p.LongitudeMin < b.LongitudeMin || p.LatitudeMax > b.LatitudeMax || p.LongitudeMax > b.LongitudeMax {
+				t.Errorf("%s: bounds %v of %s do not cover the points %v", test.name, *b, zone.Geohash, *p)
+			}
+		}
+	}
+}
+
+func TestMergeAnnotationsAverage(t *testing.T) {
+	request := &fetchMapAnnotationRequest{
+		fetchMapAnnotationRequestParams: fetchMapAnnotationRequestParams{
+			PixelWidth:  1000,
+			PixelHeight: 1000,
+		},
+		bounds: bounds{0, 0, 10, 10},
+	}
+	result := &fetchMapAnnotationsResults{
+		[]*listZoneModel{newTestZone(8, 3, 2, 2), newTestZone(8, 1, 2.2, 2.2)},
+		[]*fetchPointModel{},
+	}
+	mergeAnnotations(request, result)
+	if len(result.Clusters) != 1 {
+		t.Fatalf("%d clusters, want 1", len(result.Clusters))
+	}
+
+	// the position is the average of the points of the merged clusters
+	zone := result.Clusters[0]
+	if math.Abs(zone.Latitude-2.05) > 1e-9 || math.Abs(zone.Longitude-2.05) > 1e-9 {
+		t.Errorf("Merged cluster at %v, %v, want 2.05, 2.05", zone.Latitude, zone.Longitude)
+	}
+	if reflect.DeepEqual(zone.MergedGeohashes, []string{geohash.GeohashFromCoordinates(2.2, 2.2)[:8]}) == false {
+		t.Errorf("Merged geohashes %v", zone.MergedGeohashes)
+	}
+}
+
+func TestMergeAnnotationsExpansionZoom(t *testing.T) {
+	// 100 pixels per degree around the meridian 0 and the equator, the
+	// common geohash of annotations on either side of them is empty
+	request := &fetchMapAnnotationRequest{
+		fetchMapAnnotationRequestParams: fetchMapAnnotationRequestParams{
+			PixelWidth:  1000,
+			PixelHeight: 1000,
+		},
+		bounds: bounds{-5, -5, 5, 5},
+	}
+	minZoom := int(math.Floor(request.zoomLevel())) + 1
+
+	clusters := []*listZoneModel{newTestZone(8, 10, 0.1, 0.1), newTestZone(8, 5, -0.1, -0.1)}
+	clusters[0].ExpansionZoom = minZoom + 4
+	clusters[1].ExpansionZoom = minZoom + 2
+	result := &fetchMapAnnotationsResults{clusters, []*fetchPointModel{}}
+	mergeAnnotations(request, result)
+	if len(result.Clusters) != 1 {
+		t.Fatalf("Merged clusters into %d clusters, want 1", len(result.Clusters))
+	}
+	if result.Clusters[0].ExpansionZoom != minZoom+2 {
+		t.Errorf("Merged clusters expansion zoom %d, want %d", result.Clusters[0].ExpansionZoom, minZoom+2)
+	}
+
+	result = &fetchMapAnnotationsResults{
+		[]*listZoneModel{},
+		[]*fetchPointModel{{Identifier: "a", Latitude: 0.05, Longitude: 0.05}, {Identifier: "b", Latitude: -0.05, Longitude: -0.05}},
+	}
+	mergeAnnotations(request, result)
+	if len(result.Clusters) != 1 {
+		t.Fatalf("Merged points into %d clusters, want 1", len(result.Clusters))
+	}
+	if result.Clusters[0].ExpansionZoom != minZoom {
+		t.Errorf("Merged points expansion zoom %d, want %d", result.Clusters[0].ExpansionZoom, minZoom)
+	}
+
+	// the zones left alone keep the expansion zoom of the engine
+	zone := newTestZone(8, 10, 2, 2)
+	zone.ExpansionZoom = minZoom + 7
+	result = &fetchMapAnnotationsResults{[]*listZoneModel{zone}, []*fetchPointModel{}}
+	mergeAnnotations(request, result)
+	if result.Clusters[0].ExpansionZoom != minZoom+7 {
+		t.Errorf("Expansion zoom %d, want %d", result.Clusters[0].ExpansionZoom, minZoom+7)
+	}
+}
@@ -0,0 +1,229 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/vitaminwater/parsemap/geohash"
+)
+
+/**
+ * Nearby points
+ * the candidates are the points in the cells surrounding the position, or
+ * in the cells covering a circle around it, the database returns the
+ * closest ones.
+ */
+
+const (
+	defaultNearbyLimit  = 20
+	maxNearbyLimit      = 100
+	maxNearbyCoverCells = 64
+)
+
+type fetchListNearbyRequestParams struct {
+	Latitude  float64 `form:"latitude"`
+	Longitude float64 `form:"longitude"`
+	Radius    float64 `form:"radius"`
+	Limit     int     `form:"limit"`
+}
+
+type fetchListNearbyRequest struct {
+	fetchListNearbyRequestParams
+
+	list string
+}
+
+type nearbyPointModel struct {
+	*fetchPointModel
+
+	// great-circle distance, in metres
+	Distance float64 `json:"distance"`
+}
+
+type nearbyPointsByDistance []*nearbyPointModel
+
+func (p nearbyPointsByDistance) Len() int           { return len(p) }
+func (p nearbyPointsByDistance) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p nearbyPointsByDistance) Less(i, j int) bool { return p[i].Distance < p[j].Distance }
+
+// geohashCellSize returns the smallest side of a geohash cell at the
+// latitude, in metres.
+func geohashCellSize(geohashLength int, latitude float64) float64 {
+	metresPerDegree := math.Pi * geohash.EarthRadius / 180
+	n := math.Exp2(float64(geohashLength))
+	height := 180 / n * metresPerDegree
+	width := 180 / n * metresPerDegree * math.Cos(latitude*math.Pi/180)
+	return math.Min(height, width)
+}
+
+// geohashesPattern returns the similar to pattern matching the geohashes,
+// as expected by get_list_point.
+func geohashesPattern(hashes []string) string {
+	return "(" + strings.Join(hashes, "|") + ")"
+}
+
+type zoneCountModel struct {
+	Level   int
+	NPoints int `db:"n_points"`
+}
+
+// nearbyGrid returns the cells surrounding the cell of the given length
+// containing the position, the points closer than the size of the cell are
+// in them.
+func nearbyGrid(latitude, longitude float64, geohashLength int) ([]string, error) {
+	hash := geohash.GeohashFromCoordinates(latitude, longitude)[:geohashLength]
+
+	hashes := []string{hash}
+	seen := map[string]bool{hash: true}
+	for direction := geohash.North; direction <= geohash.NorthWest; direction++ {
+		cell, err := geohash.Neighbour(hash, direction)
+		if err == geohash.ErrNoNeighbour {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if seen[cell] == false {
+			seen[cell] = true
+			hashes = append(hashes, cell)
+		}
+	}
+	return hashes, nil
+}
+
+// nearbyGeohashLength returns the longest geohash length for which the
+// cells surrounding the position hold at least request.Limit points, the
+// zones of all the lengths are counted in one query.
+func nearbyGeohashLength(request *fetchListNearbyRequest) (int, error) {
+	hashes := []string{}
+	for geohashLength := minZoneGeohashLength; geohashLength <= maxZoneGeohashLength; geohashLength++ {
+		grid, err := nearbyGrid(request.Latitude, request.Longitude, geohashLength)
+		if err != nil {
+			return 0, err
+		}
+		hashes = append(hashes, grid...)
+	}
+
+	counts := []*zoneCountModel{}
+	query := fmt.Sprintf("select * from get_list_zone_counts($1, '%s')", generateSQLStringArray(hashes))
+	if err := db.Select(&counts, query, request.list); err != nil {
+		return 0, err
+	}
+
+	result := minZoneGeohashLength
+	for _, count := range counts {
+		if count.NPoints >= request.Limit && count.Level > result {
+			result = count.Level
+		}
+	}
+	return result, nil
+}
+
+// fetchClosestPoints returns the request.Limit points of the cells closest
+// to the position, closer than radius metres when it is positive, the
+// database orders them by distance.
+func fetchClosestPoints(request *fetchListNearbyRequest, hashes []string, radius float64) ([]*nearbyPointModel, error) {
+	var maxDistance *float64
+	if radius > 0 {
+		maxDistance = &radius
+	}
+
+	points := []*fetchPointModel{}
+	if err := db.Select(&points, "select * from get_list_point_nearby($1, $2, $3, $4, $5, $6)", request.list, geohashesPattern(hashes), request.Latitude, request.Longitude, maxDistance, request.Limit); err != nil {
+		return nil, err
+	}
+
+	result := make([]*nearbyPointModel, 0, len(points))
+	for _, point := range points {
+		result = append(result, &nearbyPointModel{point, geohash.Distance(request.Latitude, request.Longitude, point.Latitude, point.Longitude)})
+	}
+	sort.Stable(nearbyPointsByDistance(result))
+	return result, nil
+}
+
+// fetchPointsInCircle returns the request.Limit points closest to the
+// position and closer than radius metres, the circle is covered by at most
+// maxNearbyCoverCells cells.
+func fetchPointsInCircle(request *fetchListNearbyRequest, radius float64) ([]*nearbyPointModel, error) {
+	b := boxBounds(geohash.CircleBox(request.Latitude, request.Longitude, radius))
+	geohashLength := b.coverGeohashLength(minZoneGeohashLength, maxNearbyCoverCells)
+	return fetchClosestPoints(request, geohash.CoverCircle(request.Latitude, request.Longitude, radius, geohashLength), radius)
+}
+
+// fetchNearbyPoints returns the request.Limit points closest to the
+// position. Without a radius, the closest points of the smallest grid
+// holding enough points are the result when they are closer than the size
+// of its cells, otherwise the closest points are in the circle reaching the
+// farthest of them.
+func fetchNearbyPoints(request *fetchListNearbyRequest) ([]*nearbyPointModel, error) {
+	if request.Radius > 0 {
+		return fetchPointsInCircle(request, request.Radius)
+	}
+
+	geohashLength, err := nearbyGeohashLength(request)
+	if err != nil {
+		return nil, err
+	}
+	grid, err := nearbyGrid(request.Latitude, request.Longitude, geohashLength)
+	if err != nil {
+		return nil, err
+	}
+	points, err := fetchClosestPoints(request, grid, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(points) < request.Limit || points[len(points)-1].Distance <= geohashCellSize(geohashLength, request.Latitude) {
+		return points, nil
+	}
+	// a millimetre more, the database rounds the distances on its own
+	return fetchPointsInCircle(request, points[len(points)-1].Distance+0.001)
+}
+
+func fetchListNearbyHandler(c *gin.Context) {
+	request := fetchListNearbyRequest{}
+
+	if err := c.BindWith(&request.fetchListNearbyRequestParams, binding.Form); err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusBadRequest)
+		return
+	}
+
+	request.list = c.Params.ByName("list")
+
+	if len(c.Query("latitude")) == 0 || len(c.Query("longitude")) == 0 {
+		outputJSONErrorCheckType(c.Writer, errors.New("Missing latitude or longitude"), http.StatusBadRequest)
+		return
+	}
+	if allFinite(request.Latitude, request.Longitude, request.Radius) == false || request.Latitude < -90 || request.Latitude > 90 || request.Longitude < -180 || request.Longitude > 180 {
+		outputJSONErrorCheckType(c.Writer, errors.New("Wrong latitude or longitude"), http.StatusBadRequest)
+		return
+	}
+	if request.Radius < 0 {
+		outputJSONErrorCheckType(c.Writer, errors.New("Wrong radius, must be positive"), http.StatusBadRequest)
+		return
+	}
+	if request.Limit <= 0 {
+		request.Limit = defaultNearbyLimit
+	} else if request.Limit > maxNearbyLimit {
+		request.Limit = maxNearbyLimit
+	}
+
+	nearbyPoints, err := fetchNearbyPoints(&request)
+	if err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusInternalServerError)
+		return
+	}
+
+	points := make([]*fetchPointModel, 0, len(nearbyPoints))
+	properties := make([]map[string]interface{}, 0, len(nearbyPoints))
+	for _, point := range nearbyPoints {
+		points = append(points, point.fetchPointModel)
+		properties = append(properties, map[string]interface{}{"distance": point.Distance})
+	}
+	outputPointsWithMetas(c, request.list, points, properties, nearbyPoints)
+}
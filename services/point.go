@@ -3,11 +3,12 @@ package services
 import (
 	"fmt"
 	"net/http"
+	"sort"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
-	"github.com/vitaminwater/geohash"
+	"github.com/vitaminwater/parsemap/geohash"
 	"gopkg.in/guregu/null.v2"
 )
 
@@ -103,6 +104,15 @@ func associateMetasForPoints(pointes []*fetchPointModel, list string) error {
 	return nil
 }
 
+// associateMetasForUnsortedPoints associates the metas of points in any
+// order, associateMetasForPoints expects them in the order of their ids.
+func associateMetasForUnsortedPoints(points []*fetchPointModel, list string) error {
+	sorted := make([]*fetchPointModel, len(points))
+	copy(sorted, points)
+	sort.Sort(pointsById(sorted))
+	return associateMetasForPoints(sorted, list)
+}
+
 /**
  * fetch point meta for events
  */
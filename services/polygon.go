@@ -0,0 +1,301 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/vitaminwater/parsemap/geohash"
+)
+
+/**
+ * Polygon queries
+ * the points are prefiltered with the geohash cells covering the polygon,
+ * then tested against the polygon.
+ */
+
+const (
+	maxPolygonCoverCells  = 64
+	defaultPolygonLimit   = 500
+	maxPolygonLimit       = 5000
+	polygonPageSize       = 10000
+	maxPolygonRingsPoints = 10000
+)
+
+// a ring is a list of [longitude, latitude] positions, the first ring of a
+// polygon is its exterior, the others are holes.
+type polygon [][][]float64
+
+// geoJSONPolygonParams is a GeoJSON Polygon or MultiPolygon geometry, or a
+// Feature holding one.
+type geoJSONPolygonParams struct {
+	Type        string                `json:"type"`
+	Coordinates json.RawMessage       `json:"coordinates"`
+	Geometry    *geoJSONPolygonParams `json:"geometry"`
+}
+
+type fetchListPolygonRequestParams struct {
+	Clusters         bool    `form:"clusters"`
+	Zoom             float64 `form:"zoom"`
+	AnnotationWidth  float64 `form:"annotationWidth"`
+	AnnotationHeight float64 `form:"annotationHeight"`
+	Limit            int     `form:"limit"`
+}
+
+type fetchListPolygonRequest struct {
+	fetchListPolygonRequestParams
+
+	list     string
+	polygons []polygon
+	bounds   bounds
+}
+
+// parsePolygons returns the polygons of the geometry, as a list of polygons.
+func parsePolygons(geometry *geoJSONPolygonParams) ([]polygon, error) {
+	if geometry.Type == "Feature" {
+		if geometry.Geometry == nil {
+			return nil, errors.New("Missing feature geometry")
+		}
+		return parsePolygons(geometry.Geometry)
+	}
+
+	polygons := []polygon{}
+	switch geometry.Type {
+	case "Polygon":
+		p := polygon{}
+		if err := json.Unmarshal(geometry.Coordinates, &p); err != nil {
+			return nil, err
+		}
+		polygons = append(polygons, p)
+	case "MultiPolygon":
+		if err := json.Unmarshal(geometry.Coordinates, &polygons); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Wrong geometry type %s, must be Polygon or MultiPolygon", geometry.Type)
+	}
+
+	nPositions := 0
+	for _, p := range polygons {
+		if len(p) == 0 {
+			return nil, errors.New("Polygon without rings")
+		}
+		for _, ring := range p {
+			if len(ring) < 4 {
+				return nil, errors.New("Polygon rings must have at least 4 positions")
+			}
+			for _, position := range ring {
+				if len(position) < 2 || position[0] < -180 || position[0] > 180 || position[1] < -90 || position[1] > 90 {
+					return nil, errors.New("Wrong polygon position")
+				}
+			}
+			nPositions += len(ring)
+		}
+	}
+	if len(polygons) == 0 {
+		return nil, errors.New("Empty MultiPolygon")
+	}
+	if nPositions > maxPolygonRingsPoints {
+		return nil, fmt.Errorf("Too many positions, at most %d", maxPolygonRingsPoints)
+	}
+	return polygons, nil
+}
+
+func polygonsBounds(polygons []polygon) bounds {
+	b := bounds{90, 180, -90, -180}
+	for _, p := range polygons {
+		for _, position := range p[0] {
+			b.longitudeMin = math.Min(b.longitudeMin, position[0])
+			b.latitudeMin = math.Min(b.latitudeMin, position[1])
+			b.longitudeMax = math.Max(b.longitudeMax, position[0])
+			b.latitudeMax = math.Max(b.latitudeMax, position[1])
+		}
+	}
+	return b
+}
+
+func (p polygon) contains(latitude, longitude float64) bool {
+	return geohash.PolygonContains(p, latitude, longitude)
+}
+
+func polygonsContain(polygons []polygon, latitude, longitude float64) bool {
+	for _, p := range polygons {
+		if p.contains(latitude, longitude) {
+			return true
+		}
+	}
+	return false
+}
+
+// polygonsCover returns the geohash cells intersecting the polygons, with
+// the longest geohash length giving at most maxPolygonCoverCells cells for
+// their bounds.
+func polygonsCover(polygons []polygon, b bounds) []string {
+	geohashLength := b.coverGeohashLength(minZoneGeohashLength, maxPolygonCoverCells)
+	cover := []string{}
+	seen := map[string]bool{}
+	for _, p := range polygons {
+		for _, hash := range geohash.CoverPolygon(p, geohashLength) {
+			if seen[hash] == false {
+				seen[hash] = true
+				cover = append(cover, hash)
+			}
+		}
+	}
+	return cover
+}
+
+// fetchPointsInPolygons pages through the points of the cover, in the order
+// they were added to the list, until request.Limit of them are inside the
+// polygons.
+func fetchPointsInPolygons(request *fetchListPolygonRequest) ([]*fetchPointModel, error) {
+	points := []*fetchPointModel{}
+	cover := polygonsCover(request.polygons, request.bounds)
+	if len(cover) == 0 {
+		return points, nil
+	}
+	pattern := geohashesPattern(cover)
+
+	afterDate, afterId := time.Time{}, uint64(0)
+	for {
+		candidates := []*fetchPointModel{}
+		if err := db.Select(&candidates, "select * from get_list_point_page($1, $2, '{}', $3, $4, $5)", request.list, pattern, afterDate, afterId, polygonPageSize); err != nil {
+			return nil, err
+		}
+		for _, point := range candidates {
+			if polygonsContain(request.polygons, point.Latitude, point.Longitude) {
+				points = append(points, point)
+				if len(points) >= request.Limit {
+					return points, nil
+				}
+			}
+		}
+
+		if len(candidates) < polygonPageSize {
+			return points, nil
+		}
+		last := candidates[len(candidates)-1]
+		afterDate, afterId = last.DateCreated, last.Id
+	}
+}
+
+// geohashLength returns the geohash length of the clusters for the zoom
+// level, bounded by the cover of the polygons.
+func (request *fetchListPolygonRequest) geohashLength(settings *clusterSettings) (int, error) {
+	annotationSize := math.Max(request.AnnotationWidth, request.AnnotationHeight)
+	if annotationSize <= 0 {
+		annotationSize = defaultZoomAnnotationSize
+	}
+	latitude := (request.bounds.latitudeMin + request.bounds.latitudeMax) / 2
+	return settings.boundGeohashLength(request.bounds, geohashLengthForZoom(request.Zoom, latitude, annotationSize))
+}
+
+// fetchAnnotationsInPolygons returns the clusters and the points inside the
+// polygons, with the engine of the list. The clusters are kept when their
+// average position is inside, they are not split at the polygon edges, so
+// their n_points can count points outside of the polygons.
+func fetchAnnotationsInPolygons(request *fetchListPolygonRequest, geohashLength int, settings *clusterSettings) (*fetchMapAnnotationsResults, error) {
+	result, err := fetchAnnotations(request.list, request.bounds, request.Zoom, geohashLength, settings)
+	if err != nil {
+		return nil, err
+	}
+
+	clusters := []*listZoneModel{}
+	for _, zone := range result.Clusters {
+		if polygonsContain(request.polygons, zone.Latitude, zone.Longitude) {
+			clusters = append(clusters, zone)
+		}
+	}
+	points := []*fetchPointModel{}
+	for _, point := range result.Points {
+		if polygonsContain(request.polygons, point.Latitude, point.Longitude) {
+			points = append(points, point)
+		}
+	}
+	result.Clusters = clusters
+	result.Points = points
+	return result, nil
+}
+
+func fetchListPolygonHandler(c *gin.Context) {
+	request := fetchListPolygonRequest{}
+
+	geometry := geoJSONPolygonParams{}
+	if err := c.BindWith(&geometry, binding.JSON); err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusBadRequest)
+		return
+	}
+	if err := c.BindWith(&request.fetchListPolygonRequestParams, binding.Form); err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusBadRequest)
+		return
+	}
+
+	request.list = c.Params.ByName("list")
+
+	polygons, err := parsePolygons(&geometry)
+	if err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusBadRequest)
+		return
+	}
+	request.polygons = polygons
+	request.bounds = polygonsBounds(polygons)
+
+	if request.Limit <= 0 {
+		request.Limit = defaultPolygonLimit
+	} else if request.Limit > maxPolygonLimit {
+		request.Limit = maxPolygonLimit
+	}
+
+	if request.Clusters && len(c.Query("zoom")) == 0 {
+		outputJSONErrorCheckType(c.Writer, errors.New("Missing zoom, required with clusters"), http.StatusBadRequest)
+		return
+	}
+	if request.Clusters && (allFinite(request.Zoom) == false || request.Zoom < 0 || request.Zoom > maxZoom) {
+		outputJSONErrorCheckType(c.Writer, fmt.Errorf("Wrong zoom level, must be between 0 and %d", maxZoom), http.StatusBadRequest)
+		return
+	}
+
+	if request.Clusters {
+		settings, err := getListClusterSettings(request.list)
+		if err != nil {
+			outputJSONErrorCheckType(c.Writer, err, http.StatusInternalServerError)
+			return
+		}
+		if err := settings.override(c); err != nil {
+			outputJSONErrorCheckType(c.Writer, err, http.StatusBadRequest)
+			return
+		}
+		geohashLength, err := request.geohashLength(settings)
+		if err != nil {
+			outputJSONErrorCheckType(c.Writer, err, http.StatusBadRequest)
+			return
+		}
+
+		result, err := fetchAnnotationsInPolygons(&request, geohashLength, settings)
+		if err != nil {
+			outputJSONErrorCheckType(c.Writer, err, http.StatusInternalServerError)
+			return
+		}
+		if wantsGeoJSON(c) {
+			fc := newGeoJSONFeatureCollection()
+			fc.addZones(result.Clusters)
+			fc.addPoints(result.Points)
+			outputGeoJSON(c.Writer, http.StatusOK, fc)
+			return
+		}
+		c.JSON(http.StatusOK, result)
+		return
+	}
+
+	points, err := fetchPointsInPolygons(&request)
+	if err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusInternalServerError)
+		return
+	}
+	outputPointsWithMetas(c, request.list, points, nil, points)
+}
@@ -0,0 +1,34 @@
+package services
+
+import (
+	"fmt"
+	"io"
+)
+
+/**
+ * Zones rebuild, used by the rebuild-zones command
+ */
+
+type zoneDriftModel struct {
+	Level          int     `db:"zone_level"`
+	Geohash        string  `db:"zone_geohash"`
+	StoredNPoints  int     `db:"stored_n_points"`
+	ActualNPoints  int     `db:"actual_n_points"`
+	LatitudeDrift  float64 `db:"latitude_drift"`
+	LongitudeDrift float64 `db:"longitude_drift"`
+}
+
+// RebuildListZones recomputes all the zones of the list from its points,
+// and writes the zones that drifted to w.
+func RebuildListZones(list string, w io.Writer) error {
+	drifts := []*zoneDriftModel{}
+	if err := db.Select(&drifts, "select * from rebuild_list_zones($1)", list); err != nil {
+		return err
+	}
+
+	for _, drift := range drifts {
+		fmt.Fprintf(w, "level %2d %-17s n_points %d -> %d, latitude drift %g, longitude drift %g\n", drift.Level, drift.Geohash, drift.StoredNPoints, drift.ActualNPoints, drift.LatitudeDrift, drift.LongitudeDrift)
+	}
+	fmt.Fprintf(w, "%d zones drifted in list %s\n", len(drifts), list)
+	return nil
+}
@@ -0,0 +1,171 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/vitaminwater/parsemap/geohash"
+)
+
+/**
+ * Point search
+ * prefix and accent insensitive matching of the words of the query on the
+ * names of the points, and optionally on fields of their metas.
+ */
+
+const (
+	defaultSearchLimit  = 20
+	maxSearchLimit      = 100
+	maxSearchFields     = 10
+	maxSearchCoverCells = 64
+)
+
+type searchListPointsRequestParams struct {
+	Query  string   `form:"q"`
+	Fields []string `form:"fields[]"`
+
+	// optional viewport, all four are required
+	LatitudeMin  float64 `form:"latitudeMin"`
+	LongitudeMin float64 `form:"longitudeMin"`
+	LatitudeMax  float64 `form:"latitudeMax"`
+	LongitudeMax float64 `form:"longitudeMax"`
+
+	// optional geohash prefix
+	Geohash string `form:"geohash"`
+
+	// optional position to rank by distance, defaults to the center of the
+	// viewport
+	Latitude  float64 `form:"latitude"`
+	Longitude float64 `form:"longitude"`
+
+	Limit int `form:"limit"`
+}
+
+type searchListPointsRequest struct {
+	searchListPointsRequestParams
+
+	list       string
+	bounds     bounds
+	position   bool
+	inViewport bool
+}
+
+type searchPointModel struct {
+	fetchPointModel
+
+	// 3 when the name starts with the query, 2 when the name matches, 1 when
+	// the metas match
+	Rank int `json:"rank"`
+
+	// great-circle distance to the position, in metres
+	Distance *float64 `db:"-" json:"distance,omitempty"`
+}
+
+func searchListPoints(request *searchListPointsRequest) ([]*searchPointModel, error) {
+	hashes := []string{request.Geohash}
+	if request.inViewport {
+		hashes = request.bounds.geohashes(request.bounds.coverGeohashLength(0, maxSearchCoverCells))
+	}
+
+	var latitude, longitude *float64
+	if request.position {
+		latitude, longitude = &request.Latitude, &request.Longitude
+	}
+
+	points := []*searchPointModel{}
+	query := "select * from search_list_points($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)"
+	if err := db.Select(&points, query, request.list, request.Query, generateSQLStringArray(request.Fields), geohashesPattern(hashes),
+		request.bounds.latitudeMin, request.bounds.longitudeMin, request.bounds.latitudeMax, request.bounds.longitudeMax,
+		latitude, longitude, request.Limit); err != nil {
+		return nil, err
+	}
+
+	if request.position {
+		for _, point := range points {
+			d := geohash.Distance(request.Latitude, request.Longitude, point.Latitude, point.Longitude)
+			point.Distance = &d
+		}
+	}
+	return points, nil
+}
+
+func searchListPointsHandler(c *gin.Context) {
+	request := searchListPointsRequest{}
+
+	if err := c.BindWith(&request.searchListPointsRequestParams, binding.Form); err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusBadRequest)
+		return
+	}
+
+	request.list = c.Params.ByName("list")
+
+	if len(strings.TrimSpace(request.Query)) == 0 {
+		outputJSONErrorCheckType(c.Writer, errors.New("Missing q"), http.StatusBadRequest)
+		return
+	}
+	if len(request.Fields) > maxSearchFields {
+		outputJSONErrorCheckType(c.Writer, errors.New("Too many fields"), http.StatusBadRequest)
+		return
+	}
+	if len(request.Geohash) > maxZoneGeohashLength || geohash.Valid(request.Geohash) == false {
+		outputJSONErrorCheckType(c.Writer, errors.New("Wrong geohash"), http.StatusBadRequest)
+		return
+	}
+
+	request.bounds = bounds{-90, -180, 90, 180}
+	if len(c.Query("latitudeMin")) > 0 || len(c.Query("longitudeMin")) > 0 || len(c.Query("latitudeMax")) > 0 || len(c.Query("longitudeMax")) > 0 {
+		if len(c.Query("latitudeMin")) == 0 || len(c.Query("longitudeMin")) == 0 || len(c.Query("latitudeMax")) == 0 || len(c.Query("longitudeMax")) == 0 {
+			outputJSONErrorCheckType(c.Writer, errors.New("Missing latitudeMin, longitudeMin, latitudeMax or longitudeMax"), http.StatusBadRequest)
+			return
+		}
+		if len(request.Geohash) > 0 {
+			outputJSONErrorCheckType(c.Writer, errors.New("The viewport and the geohash can not be used together"), http.StatusBadRequest)
+			return
+		}
+		request.bounds = newBounds(request.LatitudeMin, request.LongitudeMin, request.LatitudeMax, request.LongitudeMax)
+		request.inViewport = true
+	}
+
+	if len(c.Query("latitude")) > 0 || len(c.Query("longitude")) > 0 {
+		if len(c.Query("latitude")) == 0 || len(c.Query("longitude")) == 0 {
+			outputJSONErrorCheckType(c.Writer, errors.New("Missing latitude or longitude"), http.StatusBadRequest)
+			return
+		}
+		if request.Latitude < -90 || request.Latitude > 90 || request.Longitude < -180 || request.Longitude > 180 {
+			outputJSONErrorCheckType(c.Writer, errors.New("Wrong latitude or longitude"), http.StatusBadRequest)
+			return
+		}
+		request.position = true
+	} else if request.inViewport {
+		request.Latitude = (request.bounds.latitudeMin + request.bounds.latitudeMax) / 2
+		request.Longitude = wrapLongitude(request.bounds.longitudeMin + request.bounds.longitudeSpan()/2)
+		request.position = true
+	}
+
+	if request.Limit <= 0 {
+		request.Limit = defaultSearchLimit
+	} else if request.Limit > maxSearchLimit {
+		request.Limit = maxSearchLimit
+	}
+
+	results, err := searchListPoints(&request)
+	if err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusInternalServerError)
+		return
+	}
+
+	points := make([]*fetchPointModel, 0, len(results))
+	properties := make([]map[string]interface{}, 0, len(results))
+	for _, result := range results {
+		points = append(points, &result.fetchPointModel)
+		p := map[string]interface{}{"rank": result.Rank}
+		if result.Distance != nil {
+			p["distance"] = *result.Distance
+		}
+		properties = append(properties, p)
+	}
+	outputPointsWithMetas(c, request.list, points, properties, results)
+}
@@ -0,0 +1,415 @@
+package services
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+/**
+ * Supercluster engine
+ * greedy hierarchical clustering of the points kept in memory, ported from
+ * https://github.com/mapbox/supercluster
+ * the index is built once per list, and rebuilt when the list changes, a
+ * new event, a new last_update or a new number of points.
+ */
+
+const (
+	superclusterRadius   = defaultZoomAnnotationSize
+	superclusterNodeSize = 64
+)
+
+// lists with more points use the geohash engine
+var superclusterMaxPoints = 10000
+
+func SetSuperclusterMaxPoints(maxPoints int) {
+	superclusterMaxPoints = maxPoints
+}
+
+type superclusterNode struct {
+	// web mercator coordinates, between 0 and 1
+	x, y float64
+
+	latitude, longitude float64
+	bounds              bounds
+	nPoints             int
+
+	// zoom level at which the node was last clustered
+	zoom int
+
+	// zoom level at which the cluster splits into its children
+	expansionZoom int
+
+	// the point for leaves, the clustered nodes of zoom + 1 for clusters
+	point    *fetchPointModel
+	children []*superclusterNode
+}
+
+func (n *superclusterNode) leaves(points []*fetchPointModel) []*fetchPointModel {
+	if n.point != nil {
+		return append(points, n.point)
+	}
+	for _, child := range n.children {
+		points = child.leaves(points)
+	}
+	return points
+}
+
+type superclusterIndex struct {
+	state listIndexStateModel
+
+	// one level per zoom, from 0 to maxZoom + 1 which only holds the points
+	levels [maxZoom + 2][]*superclusterNode
+	trees  [maxZoom + 2]*kdTree
+}
+
+func newSuperclusterIndex(points []*fetchPointModel, state listIndexStateModel) *superclusterIndex {
+	index := &superclusterIndex{state: state}
+
+	leaves := make([]*superclusterNode, 0, len(points))
+	for _, point := range points {
+		leaves = append(leaves, &superclusterNode{
+			x:         mercatorX(point.Longitude),
+			y:         mercatorY(point.Latitude),
+			latitude:  point.Latitude,
+			longitude: point.Longitude,
+			bounds:    bounds{point.Latitude, point.Longitude, point.Latitude, point.Longitude},
+			nPoints:   1,
+			zoom:      maxZoom + 2,
+			point:     point,
+		})
+	}
+	index.levels[maxZoom+1] = leaves
+	index.trees[maxZoom+1] = newKDTree(leaves)
+
+	for zoom := maxZoom; zoom >= 0; zoom-- {
+		index.levels[zoom] = index.cluster(zoom)
+		index.trees[zoom] = newKDTree(index.levels[zoom])
+	}
+	return index
+}
+
+// cluster groups the nodes of zoom + 1 closer than the annotation size at
+// the given zoom level.
+func (index *superclusterIndex) cluster(zoom int) []*superclusterNode {
+	previous := index.levels[zoom+1]
+	tree := index.trees[zoom+1]
+	radius := superclusterRadius / (mercatorTileSize * math.Exp2(float64(zoom)))
+
+	result := []*superclusterNode{}
+	for _, node := range previous {
+		if node.zoom <= zoom {
+			continue
+		}
+		node.zoom = zoom
+
+		neighbours := []*superclusterNode{}
+		for _, i := range tree.within(node.x, node.y, radius) {
+			neighbour := previous[i]
+			if neighbour.zoom > zoom {
+				neighbours = append(neighbours, neighbour)
+			}
+		}
+		if len(neighbours) == 0 {
+			result = append(result, node)
+			continue
+		}
+
+		cluster := &superclusterNode{
+			bounds:        node.bounds,
+			expansionZoom: zoom + 1,
+			children:      []*superclusterNode{node},
+		}
+		for _, child := range append([]*superclusterNode{node}, neighbours...) {
+			child.zoom = zoom
+			if child != node {
+				cluster.children = append(cluster.children, child)
+			}
+
+			weight := float64(child.nPoints)
+			cluster.x += child.x * weight
+			cluster.y += child.y * weight
+			cluster.latitude += child.latitude * weight
+			cluster.longitude += child.longitude * weight
+			cluster.nPoints += child.nPoints
+
+			cluster.bounds.latitudeMin = math.Min(cluster.bounds.latitudeMin, child.bounds.latitudeMin)
+			cluster.bounds.longitudeMin = math.Min(cluster.bounds.longitudeMin, child.bounds.longitudeMin)
+			cluster.bounds.latitudeMax = math.Max(cluster.bounds.latitudeMax, child.bounds.latitudeMax)
+			cluster.bounds.longitudeMax = math.Max(cluster.bounds.longitudeMax, child.bounds.longitudeMax)
+		}
+		total := float64(cluster.nPoints)
+		cluster.x /= total
+		cluster.y /= total
+		cluster.latitude /= total
+		cluster.longitude /= total
+
+		result = append(result, cluster)
+	}
+
+	// all the nodes of this level are considered again at the next zoom level
+	for _, node := range result {
+		node.zoom = zoom + 1
+	}
+	return result
+}
+
+// nodes returns the nodes of the zoom level in the bounds.
+func (index *superclusterIndex) nodes(b bounds, zoom int) []*superclusterNode {
+	level := index.levels[zoom]
+	result := []*superclusterNode{}
+	for _, box := range b.split() {
+		ids := index.trees[zoom].rangeQuery(mercatorX(box.longitudeMin), mercatorY(box.latitudeMax), mercatorX(box.longitudeMax), mercatorY(box.latitudeMin))
+		for _, i := range ids {
+			result = append(result, level[i])
+		}
+	}
+	return result
+}
+
+// superclusterBuild is an index being built, the requests for the same
+// version of the list wait for it instead of building their own.
+type superclusterBuild struct {
+	state listIndexStateModel
+	done  chan struct{}
+	index *superclusterIndex
+	err   error
+}
+
+var superclusterIndexes = struct {
+	sync.Mutex
+	indexes map[string]*superclusterIndex
+	builds  map[string]*superclusterBuild
+}{indexes: map[string]*superclusterIndex{}, builds: map[string]*superclusterBuild{}}
+
+type listIndexStateModel struct {
+	LastEventId int       `db:"last_event_id"`
+	LastUpdate  time.Time `db:"last_update"`
+	NPoints     int       `db:"n_points"`
+}
+
+func (s listIndexStateModel) equal(other listIndexStateModel) bool {
+	return s.LastEventId == other.LastEventId && s.LastUpdate.Equal(other.LastUpdate) && s.NPoints == other.NPoints
+}
+
+// getSuperclusterIndex returns the index of the list, nil when the list is
+// too large for the supercluster engine.
+func getSuperclusterIndex(list string) (*superclusterIndex, error) {
+	state := listIndexStateModel{}
+	if err := db.Get(&state, "select * from get_list_index_state($1)", list); err != nil {
+		return nil, err
+	}
+	if state.NPoints > superclusterMaxPoints {
+		return nil, nil
+	}
+
+	superclusterIndexes.Lock()
+	if index := superclusterIndexes.indexes[list]; index != nil && index.state.equal(state) {
+		superclusterIndexes.Unlock()
+		return index, nil
+	}
+	if build := superclusterIndexes.builds[list]; build != nil && build.state.equal(state) {
+		superclusterIndexes.Unlock()
+		<-build.done
+		return build.index, build.err
+	}
+	build := &superclusterBuild{state: state, done: make(chan struct{})}
+	superclusterIndexes.builds[list] = build
+	superclusterIndexes.Unlock()
+
+	points := []*fetchPointModel{}
+	if build.err = db.Select(&points, "select * from get_list_points_for_index($1)", list); build.err == nil {
+		build.index = newSuperclusterIndex(points, state)
+	}
+
+	// a build of a newer version keeps its place
+	superclusterIndexes.Lock()
+	if superclusterIndexes.builds[list] == build {
+		delete(superclusterIndexes.builds, list)
+		if build.err == nil {
+			superclusterIndexes.indexes[list] = build.index
+		}
+	}
+	superclusterIndexes.Unlock()
+	close(build.done)
+	return build.index, build.err
+}
+
+type pointsById []*fetchPointModel
+
+func (p pointsById) Len() int           { return len(p) }
+func (p pointsById) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p pointsById) Less(i, j int) bool { return p[i].Id < p[j].Id }
+
+func fetchSuperclusterAnnotations(list string, index *superclusterIndex, b bounds, zoom float64, settings *clusterSettings) (*fetchMapAnnotationsResults, error) {
+	z := int(math.Max(0, math.Min(maxZoom, math.Floor(zoom))))
+
+	result := &fetchMapAnnotationsResults{
+		[]*listZoneModel{},
+		[]*fetchPointModel{},
+	}
+	leaves := []*fetchPointModel{}
+	for _, node := range index.nodes(b, z) {
+		if node.point != nil || node.nPoints <= settings.ExpandThreshold {
+			leaves = node.leaves(leaves)
+			continue
+		}
+		zone := &listZoneModel{
+			Geohash:      node.bounds.commonGeohash(),
+			NPoints:      node.nPoints,
+			Latitude:     node.latitude,
+			Longitude:    node.longitude,
+			MinLatitude:  node.bounds.latitudeMin,
+			MinLongitude: node.bounds.longitudeMin,
+			MaxLatitude:  node.bounds.latitudeMax,
+			MaxLongitude: node.bounds.longitudeMax,
+		}
+		zone.setBounds()
+		zone.ExpansionZoom = node.expansionZoom
+		result.Clusters = append(result.Clusters, zone)
+	}
+
+	// the indexed points are shared between requests, their metas are not
+	for _, leaf := range leaves {
+		point := *leaf
+		result.Points = append(result.Points, &point)
+	}
+	sort.Sort(pointsById(result.Points))
+	if err := associateMetasForPoints(result.Points, list); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// fetchAnnotations returns the annotations with the engine of the settings,
+// the geohash engine is used for the lists too large for the supercluster
+// engine.
+func fetchAnnotations(list string, b bounds, zoom float64, geohashLength int, settings *clusterSettings) (*fetchMapAnnotationsResults, error) {
+	if settings.Engine == superclusterEngine {
+		index, err := getSuperclusterIndex(list)
+		if err != nil {
+			return nil, err
+		}
+		if index != nil {
+			return fetchSuperclusterAnnotations(list, index, b, zoom, settings)
+		}
+	}
+	return fetchAnnotationsInBounds(list, b, geohashLength, settings)
+}
+
+/**
+ * Static KD-tree, ported from https://github.com/mourner/kdbush
+ */
+
+type kdTree struct {
+	ids    []int
+	coords []float64
+}
+
+func newKDTree(nodes []*superclusterNode) *kdTree {
+	t := &kdTree{
+		ids:    make([]int, len(nodes)),
+		coords: make([]float64, len(nodes)*2),
+	}
+	for i, node := range nodes {
+		t.ids[i] = i
+		t.coords[i*2] = node.x
+		t.coords[i*2+1] = node.y
+	}
+	t.sort(0, len(nodes)-1, 0)
+	return t
+}
+
+func (t *kdTree) sort(left, right, axis int) {
+	if right-left <= superclusterNodeSize {
+		return
+	}
+	m := (left + right) / 2
+	t.selectKth(m, left, right, axis)
+	t.sort(left, m-1, 1-axis)
+	t.sort(m+1, right, 1-axis)
+}
+
+// selectKth moves the k-th smallest item on the axis at position k, with the
+// smaller items before it and the larger after.
+func (t *kdTree) selectKth(k, left, right, axis int) {
+	for right > left {
+		pivot := t.coords[k*2+axis]
+		t.swap(k, right)
+		store := left
+		for i := left; i < right; i++ {
+			if t.coords[i*2+axis] < pivot {
+				t.swap(i, store)
+				store++
+			}
+		}
+		t.swap(store, right)
+		if store == k {
+			return
+		} else if store < k {
+			left = store + 1
+		} else {
+			right = store - 1
+		}
+	}
+}
+
+func (t *kdTree) swap(i, j int) {
+	t.ids[i], t.ids[j] = t.ids[j], t.ids[i]
+	t.coords[i*2], t.coords[j*2] = t.coords[j*2], t.coords[i*2]
+	t.coords[i*2+1], t.coords[j*2+1] = t.coords[j*2+1], t.coords[i*2+1]
+}
+
+// query walks the tree, keeping the branches intersecting the box.
+func (t *kdTree) query(minX, minY, maxX, maxY float64, keep func(x, y float64) bool) []int {
+	result := []int{}
+	stack := []int{0, len(t.ids) - 1, 0}
+	for len(stack) > 0 {
+		axis := stack[len(stack)-1]
+		right := stack[len(stack)-2]
+		left := stack[len(stack)-3]
+		stack = stack[:len(stack)-3]
+
+		if right-left <= superclusterNodeSize {
+			for i := left; i <= right; i++ {
+				if keep(t.coords[i*2], t.coords[i*2+1]) {
+					result = append(result, t.ids[i])
+				}
+			}
+			continue
+		}
+
+		m := (left + right) / 2
+		x, y := t.coords[m*2], t.coords[m*2+1]
+		if keep(x, y) {
+			result = append(result, t.ids[m])
+		}
+
+		v := x
+		min, max := minX, maxX
+		if axis == 1 {
+			v, min, max = y, minY, maxY
+		}
+		if min <= v {
+			stack = append(stack, left, m-1, 1-axis)
+		}
+		if max >= v {
+			stack = append(stack, m+1, right, 1-axis)
+		}
+	}
+	return result
+}
+
+func (t *kdTree) rangeQuery(minX, minY, maxX, maxY float64) []int {
+	return t.query(minX, minY, maxX, maxY, func(x, y float64) bool {
+		return x >= minX && x <= maxX && y >= minY && y <= maxY
+	})
+}
+
+func (t *kdTree) within(qx, qy, r float64) []int {
+	r2 := r * r
+	return t.query(qx-r, qy-r, qx+r, qy+r, func(x, y float64) bool {
+		return (x-qx)*(x-qx)+(y-qy)*(y-qy) <= r2
+	})
+}
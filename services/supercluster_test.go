@@ -0,0 +1,140 @@
+package services
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func randomSuperclusterNodes(n int) []*superclusterNode {
+	nodes := make([]*superclusterNode, 0, n)
+	for i := 0; i < n; i++ {
+		nodes = append(nodes, &superclusterNode{x: rand.Float64(), y: rand.Float64()})
+	}
+	return nodes
+}
+
+func TestKDTree(t *testing.T) {
+	for _, n := range []int{0, 1, superclusterNodeSize, 1000} {
+		nodes := randomSuperclusterNodes(n)
+		tree := newKDTree(nodes)
+
+		boxes := []struct {
+			minX, minY, maxX, maxY float64
+		}{
+			{0, 0, 1, 1},
+			{0.2, 0.3, 0.5, 0.4},
+			{0.9, 0.9, 0.95, 0.95},
+			{2, 2, 3, 3},
+		}
+		for _, box := range boxes {
+			want := []int{}
+			for i, node := range nodes {
+				if node.x >= box.minX && node.x <= box.maxX && node.y >= box.minY && node.y <= box.maxY {
+					want = append(want, i)
+				}
+			}
+			got := tree.rangeQuery(box.minX, box.minY, box.maxX, box.maxY)
+			sort.Ints(got)
+			if reflect.DeepEqual(got, want) == false {
+				t.Errorf("%d nodes, rangeQuery(%v) = %d ids, want %d", n, box, len(got), len(want))
+			}
+		}
+
+		circles := []struct {
+			x, y, r float64
+		}{
+			{0.5, 0.5, 0.1},
+			{0, 0, 0.3},
+			{0.7, 0.2, 0.01},
+		}
+		for _, circle := range circles {
+			want := []int{}
+			for i, node := range nodes {
+				if (node.x-circle.x)*(node.x-circle.x)+(node.y-circle.y)*(node.y-circle.y) <= circle.r*circle.r {
+					want = append(want, i)
+				}
+			}
+			got := tree.within(circle.x, circle.y, circle.r)
+			sort.Ints(got)
+			if reflect.DeepEqual(got, want) == false {
+				t.Errorf("%d nodes, within(%v) = %d ids, want %d", n, circle, len(got), len(want))
+			}
+		}
+	}
+}
+
+func TestSuperclusterIndex(t *testing.T) {
+	tests := []struct {
+		name   string
+		points [][2]float64
+		// number of nodes at zoom 0 and at maxZoom
+		nodesZoom0, nodesMaxZoom int
+	}{
+		{"empty", nil, 0, 0},
+		{"one point", [][2]float64{{48.8566, 2.3522}}, 1, 1},
+		{"close points", [][2]float64{{48.8566, 2.3522}, {48.8567, 2.3523}, {48.8568, 2.3521}}, 1, 3},
+		{"distant points", [][2]float64{{48.8566, 2.3522}, {-33.8688, 151.2093}, {40.7128, -74.006}}, 3, 3},
+		{"two groups", [][2]float64{{48.8566, 2.3522}, {48.8567, 2.3523}, {-33.8688, 151.2093}, {-33.8689, 151.2094}}, 2, 4},
+	}
+	for _, test := range tests {
+		points := []*fetchPointModel{}
+		for i, position := range test.points {
+			points = append(points, &fetchPointModel{Id: uint64(i + 1), Latitude: position[0], Longitude: position[1]})
+		}
+		index := newSuperclusterIndex(points, listIndexStateModel{})
+
+		if n := len(index.levels[0]); n != test.nodesZoom0 {
+			t.Errorf("%s: %d nodes at zoom 0, want %d", test.name, n, test.nodesZoom0)
+		}
+		if n := len(index.levels[maxZoom]); n != test.nodesMaxZoom {
+			t.Errorf("%s: %d nodes at zoom %d, want %d", test.name, n, maxZoom, test.nodesMaxZoom)
+		}
+
+		// every level has all the points, and the clusters have the points of
+		// their leaves within their bounds
+		for zoom := 0; zoom <= maxZoom+1; zoom++ {
+			nPoints := 0
+			for _, node := range index.levels[zoom] {
+				nPoints += node.nPoints
+				leaves := node.leaves(nil)
+				if len(leaves) != node.nPoints {
+					t.Errorf("%s: zoom %d, node of %d points with %d leaves", test.name, zoom, node.nPoints, len(leaves))
+				}
+				for _, leaf := range leaves {
+					if leaf.Latitude < node.bounds.latitudeMin || leaf.Latitude > node.bounds.latitudeMax || leaf.Longitude < node.bounds.longitudeMin || leaf.Longitude > node.bounds.longitudeMax {
+						t.Errorf("%s: zoom %d, leaf %v outside of the bounds %v", test.name, zoom, leaf, node.bounds)
+					}
+				}
+				if node.point == nil && (node.expansionZoom <= zoom || node.expansionZoom > maxZoom+1) {
+					t.Errorf("%s: zoom %d, cluster expanding at zoom %d", test.name, zoom, node.expansionZoom)
+				}
+			}
+			if nPoints != len(points) {
+				t.Errorf("%s: zoom %d has %d points, want %d", test.name, zoom, nPoints, len(points))
+			}
+		}
+
+		if len(points) > 0 {
+			if nodes := index.nodes(bounds{-90, -180, 90, 180}, 0); len(nodes) != test.nodesZoom0 {
+				t.Errorf("%s: nodes of the world at zoom 0 = %d, want %d", test.name, len(nodes), test.nodesZoom0)
+			}
+		}
+	}
+}
+
+func TestSuperclusterIndexAntimeridian(t *testing.T) {
+	points := []*fetchPointModel{
+		{Id: 1, Latitude: -17, Longitude: 179.5},
+		{Id: 2, Latitude: -17, Longitude: -179.5},
+		{Id: 3, Latitude: 48.8566, Longitude: 2.3522},
+	}
+	index := newSuperclusterIndex(points, listIndexStateModel{})
+
+	// a viewport crossing the antimeridian holds the points on both sides
+	nodes := index.nodes(newBounds(-20, 170, -10, -170), maxZoom+1)
+	if len(nodes) != 2 {
+		t.Errorf("%d nodes across the antimeridian, want 2", len(nodes))
+	}
+}
@@ -0,0 +1,294 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+ * Mapbox vector tiles
+ * spec: https://github.com/mapbox/vector-tile-spec/tree/master/2.1
+ */
+
+const (
+	tileExtent         = 4096
+	tileAnnotationSize = 32
+)
+
+type fetchListTileRequest struct {
+	list string
+
+	z, x, y int
+}
+
+func tileToLongitude(x, z int) float64 {
+	return float64(x)/math.Exp2(float64(z))*360 - 180
+}
+
+func tileToLatitude(y, z int) float64 {
+	n := math.Pi * (1 - 2*float64(y)/math.Exp2(float64(z)))
+	return math.Atan(math.Sinh(n)) * 180 / math.Pi
+}
+
+// returns the position of the coordinates inside the tile, in tile extent units
+func tileCoordinates(request *fetchListTileRequest, latitude, longitude float64) (int, int) {
+	n := math.Exp2(float64(request.z))
+	x := mercatorX(longitude) * n
+	y := mercatorY(latitude) * n
+	return int((x - float64(request.x)) * tileExtent), int((y - float64(request.y)) * tileExtent)
+}
+
+func parseTileParams(c *gin.Context, request *fetchListTileRequest) error {
+	var err error
+	if request.z, err = strconv.Atoi(c.Params.ByName("z")); err != nil {
+		return err
+	}
+	if request.x, err = strconv.Atoi(c.Params.ByName("x")); err != nil {
+		return err
+	}
+	if request.y, err = strconv.Atoi(strings.TrimSuffix(c.Params.ByName("y"), ".pbf")); err != nil {
+		return err
+	}
+	if request.z < 0 || request.z > maxZoom {
+		return fmt.Errorf("Wrong zoom level, must be between 0 and %d", maxZoom)
+	}
+	nTiles := 1 << uint(request.z)
+	if request.x < 0 || request.x >= nTiles || request.y < 0 || request.y >= nTiles {
+		return fmt.Errorf("Wrong tile coordinates for zoom level %d", request.z)
+	}
+	return nil
+}
+
+func fetchListTileHandler(c *gin.Context) {
+	request := fetchListTileRequest{}
+	request.list = c.Params.ByName("list")
+
+	if err := parseTileParams(c, &request); err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusBadRequest)
+		return
+	}
+
+	b := bounds{
+		latitudeMin:  tileToLatitude(request.y+1, request.z),
+		longitudeMin: tileToLongitude(request.x, request.z),
+		latitudeMax:  tileToLatitude(request.y, request.z),
+		longitudeMax: tileToLongitude(request.x+1, request.z),
+	}
+
+	settings, err := getListClusterSettings(request.list)
+	if err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusInternalServerError)
+		return
+	}
+	if err := settings.override(c); err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusBadRequest)
+		return
+	}
+
+	geohashLength := geohashLengthForZoom(float64(request.z), (b.latitudeMin+b.latitudeMax)/2, tileAnnotationSize)
+	geohashLength = settings.clampGeohashLength(geohashLength)
+
+	result, err := fetchAnnotations(request.list, b, float64(request.z), geohashLength, settings)
+	if err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusInternalServerError)
+		return
+	}
+
+	tile, err := encodeAnnotationsTile(&request, result)
+	if err != nil {
+		outputJSONErrorCheckType(c.Writer, err, http.StatusInternalServerError)
+		return
+	}
+
+	c.Data(http.StatusOK, "application/vnd.mapbox-vector-tile", tile)
+}
+
+/**
+ * Tile encoding
+ */
+
+func encodeAnnotationsTile(request *fetchListTileRequest, result *fetchMapAnnotationsResults) ([]byte, error) {
+	clusters := newTileLayer("clusters")
+	for _, zone := range result.Clusters {
+		x, y := tileCoordinates(request, zone.Latitude, zone.Longitude)
+		clusters.addPoint(x, y, []tileProperty{
+			{"n_points", zone.NPoints},
+			{"geohash", zone.Geohash},
+		})
+	}
+
+	points := newTileLayer("points")
+	for _, point := range result.Points {
+		metas, err := json.Marshal(point.Metas)
+		if err != nil {
+			return nil, err
+		}
+		x, y := tileCoordinates(request, point.Latitude, point.Longitude)
+		points.addPoint(x, y, []tileProperty{
+			{"identifier", point.Identifier},
+			{"name", point.Name},
+			{"provider", point.Provider},
+			{"provider_id", point.ProviderId},
+			{"metas", string(metas)},
+		})
+	}
+
+	tile := protoBuffer{}
+	tile.writeMessage(3, clusters.encode())
+	tile.writeMessage(3, points.encode())
+	return tile, nil
+}
+
+type tileProperty struct {
+	key   string
+	value interface{}
+}
+
+type tileLayer struct {
+	name     string
+	features []protoBuffer
+
+	keys       []string
+	keyIndex   map[string]int
+	values     []protoBuffer
+	valueIndex map[interface{}]int
+}
+
+func newTileLayer(name string) *tileLayer {
+	return &tileLayer{
+		name:       name,
+		keyIndex:   map[string]int{},
+		valueIndex: map[interface{}]int{},
+	}
+}
+
+func (l *tileLayer) key(key string) int {
+	if index, ok := l.keyIndex[key]; ok {
+		return index
+	}
+	l.keyIndex[key] = len(l.keys)
+	l.keys = append(l.keys, key)
+	return len(l.keys) - 1
+}
+
+func (l *tileLayer) value(value interface{}) int {
+	if index, ok := l.valueIndex[value]; ok {
+		return index
+	}
+	encoded := protoBuffer{}
+	switch v := value.(type) {
+	case string:
+		encoded.writeString(1, v)
+	case int:
+		encoded.writeVarintField(4, uint64(v))
+	case float64:
+		encoded.writeDouble(3, v)
+	case bool:
+		if v {
+			encoded.writeVarintField(7, 1)
+		} else {
+			encoded.writeVarintField(7, 0)
+		}
+	}
+	l.valueIndex[value] = len(l.values)
+	l.values = append(l.values, encoded)
+	return len(l.values) - 1
+}
+
+// annotations falling on a neighbour tile are dropped, they will be
+// part of the neighbour tile.
+func (l *tileLayer) addPoint(x, y int, properties []tileProperty) {
+	if x < 0 || x >= tileExtent || y < 0 || y >= tileExtent {
+		return
+	}
+
+	tags := make([]uint64, 0, len(properties)*2)
+	for _, property := range properties {
+		tags = append(tags, uint64(l.key(property.key)), uint64(l.value(property.value)))
+	}
+
+	// MoveTo command with a count of 1, followed by zigzag encoded coordinates
+	geometry := []uint64{(1 & 0x7) | (1 << 3), zigzag(x), zigzag(y)}
+
+	feature := protoBuffer{}
+	feature.writePacked(2, tags)
+	feature.writeVarintField(3, 1) // POINT
+	feature.writePacked(4, geometry)
+	l.features = append(l.features, feature)
+}
+
+func (l *tileLayer) encode() protoBuffer {
+	layer := protoBuffer{}
+	layer.writeVarintField(15, 2)
+	layer.writeString(1, l.name)
+	for _, feature := range l.features {
+		layer.writeMessage(2, feature)
+	}
+	for _, key := range l.keys {
+		layer.writeString(3, key)
+	}
+	for _, value := range l.values {
+		layer.writeMessage(4, value)
+	}
+	layer.writeVarintField(5, tileExtent)
+	return layer
+}
+
+func zigzag(n int) uint64 {
+	return uint64((int64(n) << 1) ^ (int64(n) >> 63))
+}
+
+/**
+ * Minimal protobuf writer
+ */
+
+type protoBuffer []byte
+
+func (b *protoBuffer) writeVarint(v uint64) {
+	for v >= 0x80 {
+		*b = append(*b, byte(v)|0x80)
+		v >>= 7
+	}
+	*b = append(*b, byte(v))
+}
+
+func (b *protoBuffer) writeTag(field int, wireType int) {
+	b.writeVarint(uint64(field<<3 | wireType))
+}
+
+func (b *protoBuffer) writeVarintField(field int, v uint64) {
+	b.writeTag(field, 0)
+	b.writeVarint(v)
+}
+
+func (b *protoBuffer) writeDouble(field int, v float64) {
+	b.writeTag(field, 1)
+	bits := math.Float64bits(v)
+	for i := uint(0); i < 8; i++ {
+		*b = append(*b, byte(bits>>(i*8)))
+	}
+}
+
+func (b *protoBuffer) writeMessage(field int, message []byte) {
+	b.writeTag(field, 2)
+	b.writeVarint(uint64(len(message)))
+	*b = append(*b, message...)
+}
+
+func (b *protoBuffer) writeString(field int, v string) {
+	b.writeMessage(field, []byte(v))
+}
+
+func (b *protoBuffer) writePacked(field int, values []uint64) {
+	packed := protoBuffer{}
+	for _, v := range values {
+		packed.writeVarint(v)
+	}
+	b.writeMessage(field, packed)
+}
@@ -0,0 +1,203 @@
+package services
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestProtoBuffer(t *testing.T) {
+	tests := []struct {
+		write func(b *protoBuffer)
+		bytes []byte
+	}{
+		{func(b *protoBuffer) { b.writeVarint(1) }, []byte{0x01}},
+		{func(b *protoBuffer) { b.writeVarint(300) }, []byte{0xac, 0x02}},
+		{func(b *protoBuffer) { b.writeVarintField(15, 2) }, []byte{0x78, 0x02}},
+		{func(b *protoBuffer) { b.writeString(1, "ab") }, []byte{0x0a, 0x02, 'a', 'b'}},
+		{func(b *protoBuffer) { b.writePacked(4, []uint64{9, 300}) }, []byte{0x22, 0x03, 0x09, 0xac, 0x02}},
+		{func(b *protoBuffer) { b.writeDouble(3, 1) }, []byte{0x19, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f}},
+	}
+	for i, test := range tests {
+		b := protoBuffer{}
+		test.write(&b)
+		if bytes.Equal(b, test.bytes) == false {
+			t.Errorf("test %d: % x, want % x", i, []byte(b), test.bytes)
+		}
+	}
+}
+
+func TestZigzag(t *testing.T) {
+	tests := []struct {
+		n    int
+		want uint64
+	}{
+		{0, 0},
+		{-1, 1},
+		{1, 2},
+		{-2, 3},
+		{2048, 4096},
+	}
+	for _, test := range tests {
+		if got := zigzag(test.n); got != test.want {
+			t.Errorf("zigzag(%d) = %d, want %d", test.n, got, test.want)
+		}
+	}
+}
+
+// protoField is a decoded field, varints in value, messages in message.
+type protoField struct {
+	field   int
+	value   uint64
+	message []byte
+}
+
+func readVarint(b []byte) (uint64, []byte) {
+	v, shift := uint64(0), uint(0)
+	for i, c := range b {
+		v |= uint64(c&0x7f) << shift
+		if c < 0x80 {
+			return v, b[i+1:]
+		}
+		shift += 7
+	}
+	return v, nil
+}
+
+func readProtoFields(t *testing.T, b []byte) []protoField {
+	fields := []protoField{}
+	for len(b) > 0 {
+		var tag, v uint64
+		tag, b = readVarint(b)
+		field := protoField{field: int(tag >> 3)}
+		switch tag & 0x7 {
+		case 0:
+			field.value, b = readVarint(b)
+		case 1:
+			field.message, b = b[:8], b[8:]
+		case 2:
+			v, b = readVarint(b)
+			field.message, b = b[:v], b[v:]
+		default:
+			t.Fatalf("Wrong wire type %d", tag&0x7)
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+func readPacked(b []byte) []uint64 {
+	values := []uint64{}
+	for len(b) > 0 {
+		var v uint64
+		v, b = readVarint(b)
+		values = append(values, v)
+	}
+	return values
+}
+
+func TestTileCoordinates(t *testing.T) {
+	tests := []struct {
+		request             fetchListTileRequest
+		latitude, longitude float64
+		x, y                int
+	}{
+		{fetchListTileRequest{z: 0}, 0, 0, tileExtent / 2, tileExtent / 2},
+		{fetchListTileRequest{z: 1, x: 1, y: 0}, 0, 0, 0, tileExtent},
+		{fetchListTileRequest{z: 1, x: 0, y: 0}, 0, 0, tileExtent, tileExtent},
+		{fetchListTileRequest{z: 2, x: 1, y: 1}, tileToLatitude(1, 2), tileToLongitude(1, 2), 0, 0},
+	}
+	for _, test := range tests {
+		x, y := tileCoordinates(&test.request, test.latitude, test.longitude)
+		if x != test.x || y != test.y {
+			t.Errorf("tileCoordinates(%v, %v, %v) = %d, %d, want %d, %d", test.request, test.latitude, test.longitude, x, y, test.x, test.y)
+		}
+	}
+
+	if latitude := tileToLatitude(0, 0); math.Abs(latitude-maxMercatorLatitude) > 1e-6 {
+		t.Errorf("tileToLatitude(0, 0) = %v", latitude)
+	}
+}
+
+func TestEncodeAnnotationsTile(t *testing.T) {
+	// the north east quarter of the world, the annotations outside of it are
+	// dropped
+	request := fetchListTileRequest{z: 1, x: 1, y: 0}
+	result := &fetchMapAnnotationsResults{
+		Clusters: []*listZoneModel{
+			{Geohash: "7", NPoints: 12, Latitude: 45, Longitude: 90},
+			{Geohash: "51", NPoints: 12, Latitude: 60, Longitude: 40},
+			{Geohash: "2", NPoints: 12, Latitude: -45, Longitude: -90},
+		},
+		Points: []*fetchPointModel{
+			{Identifier: "a", Name: "A", Latitude: 10, Longitude: 10},
+			{Identifier: "b", Name: "B", Latitude: -10, Longitude: 10},
+		},
+	}
+	tile, err := encodeAnnotationsTile(&request, result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layers := readProtoFields(t, tile)
+	if len(layers) != 2 || layers[0].field != 3 || layers[1].field != 3 {
+		t.Fatalf("Tile fields %v, want 2 layers", layers)
+	}
+	wants := []struct {
+		name      string
+		nFeatures int
+		keys      []string
+		nValues   int
+	}{
+		// the values are shared, 12 is written once
+		{"clusters", 2, []string{"n_points", "geohash"}, 3},
+		{"points", 1, []string{"identifier", "name", "provider", "provider_id", "metas"}, 4},
+	}
+	for i, want := range wants {
+		name, keys, features, nValues, extent, version := "", []string{}, [][]byte{}, 0, uint64(0), uint64(0)
+		for _, field := range readProtoFields(t, layers[i].message) {
+			switch field.field {
+			case 1:
+				name = string(field.message)
+			case 2:
+				features = append(features, field.message)
+			case 3:
+				keys = append(keys, string(field.message))
+			case 4:
+				nValues++
+			case 5:
+				extent = field.value
+			case 15:
+				version = field.value
+			}
+		}
+		if name != want.name || version != 2 || extent != tileExtent {
+			t.Errorf("Layer %d: name %s, version %d, extent %d", i, name, version, extent)
+		}
+		if reflect.DeepEqual(keys, want.keys) == false || nValues != want.nValues {
+			t.Errorf("Layer %s: keys %v and %d values, want %v and %d", name, keys, nValues, want.keys, want.nValues)
+		}
+		if len(features) != want.nFeatures {
+			t.Fatalf("Layer %s: %d features, want %d", name, len(features), want.nFeatures)
+		}
+
+		for _, feature := range features {
+			var tags, geometry []uint64
+			featureType := uint64(0)
+			for _, field := range readProtoFields(t, feature) {
+				switch field.field {
+				case 2:
+					tags = readPacked(field.message)
+				case 3:
+					featureType = field.value
+				case 4:
+					geometry = readPacked(field.message)
+				}
+			}
+			if featureType != 1 || len(tags) != len(want.keys)*2 || len(geometry) != 3 || geometry[0] != 9 {
+				t.Errorf("Layer %s: feature of type %d, tags %v, geometry %v", name, featureType, tags, geometry)
+			}
+		}
+	}
+}
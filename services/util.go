@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"regexp"
 	"strconv"
@@ -15,6 +16,8 @@ import (
 	"github.com/lib/pq"
 )
 
+const apiVersion = "2"
+
 func GetHandlersV2(r *gin.RouterGroup, api_key string) {
 
 	r.Use(version())
@@ -47,6 +50,15 @@ func GetHandlersV2(r *gin.RouterGroup, api_key string) {
 	public.GET("/list/:list/zones/", fetchListGeohashZones)
 	public.GET("/list/:list/annotation/", fetchMapAnnotations)
 	public.GET("/list/:list/points/", fetchListPointHandler)
+	public.GET("/list/:list/tiles/:z/:x/:y", fetchListTileHandler)
+	public.GET("/list/:list/cluster/:geohash/", fetchListClusterHandler)
+	public.GET("/list/:list/nearby/", fetchListNearbyHandler)
+	public.POST("/list/:list/polygon/", fetchListPolygonHandler)
+	public.POST("/list/:list/corridor/", fetchListCorridorHandler)
+	public.GET("/list/:list/heatmap/", fetchListHeatmapHandler)
+	public.GET("/list/:list/search/", searchListPointsHandler)
+	private.GET("/list/:list/export/", exportListHandler)
+	private.POST("/list/:list/import/", importListPointsHandler)
 	private.POST("/list/:list/point/:point/", addPointToListHandler)
 	private.DELETE("/list/:list/point/:point/", removePointFromListHandler)
 
@@ -74,7 +86,7 @@ func GetHandlersV2(r *gin.RouterGroup, api_key string) {
 
 func version() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		c.Set("version", "2")
+		c.Set("version", apiVersion)
 		c.Next()
 	}
 }
@@ -152,6 +164,17 @@ func makeUint64ArrayWithIntArray(ints []int) []uint64 {
 	return results
 }
 
+// allFinite tests whether none of the values is NaN or infinite, the form
+// binding parses "NaN" and "Inf" as floats.
+func allFinite(values ...float64) bool {
+	for _, value := range values {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return false
+		}
+	}
+	return true
+}
+
 func generateSQLIntArray(ints []uint64) string {
 	if len(ints) == 0 {
 		return "{}"
@@ -0,0 +1,215 @@
+package services
+
+import (
+	"math"
+
+	"github.com/vitaminwater/parsemap/geohash"
+)
+
+/**
+ * Web mercator helpers
+ */
+
+const (
+	mercatorTileSize          = 256
+	maxZoom                   = 22
+	defaultZoomAnnotationSize = 40
+	maxMercatorLatitude       = 85.05112878
+)
+
+// returns the web mercator x coordinate of the longitude, between 0 and 1
+func mercatorX(longitude float64) float64 {
+	return (longitude + 180) / 360
+}
+
+// returns the web mercator y coordinate of the latitude, between 0 and 1
+func mercatorY(latitude float64) float64 {
+	latitude = math.Max(-maxMercatorLatitude, math.Min(maxMercatorLatitude, latitude))
+	latRad := latitude * math.Pi / 180
+	return (1 - math.Log(math.Tan(latRad)+1/math.Cos(latRad))/math.Pi) / 2
+}
+
+// returns the longitude of the web mercator x coordinate
+func mercatorLongitude(x float64) float64 {
+	return x*360 - 180
+}
+
+// returns the latitude of the web mercator y coordinate
+func mercatorLatitude(y float64) float64 {
+	return math.Atan(math.Sinh(math.Pi*(1-2*y))) * 180 / math.Pi
+}
+
+// geohashLengthForZoom chooses the geohash length for a web mercator zoom
+// level. A geohash cell covers as many degrees of longitude as of latitude,
+// and a degree of latitude gets taller on screen as the latitude grows, so
+// the cell is sized on the area it covers on screen at the given latitude,
+// rather than on one of its sides.
+func geohashLengthForZoom(zoom, latitude, annotationSize float64) int {
+	cosLat := math.Max(math.Cos(latitude*math.Pi/180), 0.01)
+
+	// on screen size of a 180 degrees cell, of geohash length 0 if it
+	// existed, in pixels
+	cellWidth := mercatorTileSize * math.Exp2(zoom) / 2
+	cellHeight := cellWidth / cosLat
+	cellSide := math.Sqrt(cellWidth * cellHeight)
+
+	return int(math.Log2(cellSide / (annotationSize * 2)))
+}
+
+// zoomForGeohashLength is the inverse of geohashLengthForZoom, it returns
+// the lowest zoom level at which the cells have the given geohash length.
+func zoomForGeohashLength(geohashLength int, latitude, annotationSize float64) int {
+	cosLat := math.Max(math.Cos(latitude*math.Pi/180), 0.01)
+	cellSideRatio := math.Sqrt(1/cosLat) / 2
+
+	zoom := int(math.Ceil(float64(geohashLength) + math.Log2(annotationSize*2/(mercatorTileSize*cellSideRatio))))
+	if zoom > maxZoom {
+		zoom = maxZoom
+	} else if zoom < 0 {
+		zoom = 0
+	}
+	return zoom
+}
+
+/**
+ * Viewport bounds
+ */
+
+type bounds struct {
+	latitudeMin  float64
+	longitudeMin float64
+	latitudeMax  float64
+	longitudeMax float64
+}
+
+type boundsModel struct {
+	LatitudeMin  float64 `json:"latitude_min"`
+	LongitudeMin float64 `json:"longitude_min"`
+	LatitudeMax  float64 `json:"latitude_max"`
+	LongitudeMax float64 `json:"longitude_max"`
+}
+
+func (b bounds) model() *boundsModel {
+	return &boundsModel{b.latitudeMin, b.longitudeMin, b.latitudeMax, b.longitudeMax}
+}
+
+func wrapLongitude(longitude float64) float64 {
+	longitude = math.Mod(longitude+180, 360)
+	if longitude < 0 {
+		longitude += 360
+	}
+	return longitude - 180
+}
+
+// newBounds normalizes the longitudes to [-180, 180], when the viewport
+// crosses the antimeridian longitudeMin is greater than longitudeMax.
+func newBounds(latitudeMin, longitudeMin, latitudeMax, longitudeMax float64) bounds {
+	if longitudeMax-longitudeMin >= 360 {
+		return bounds{latitudeMin, -180, latitudeMax, 180}
+	}
+	if longitudeMin < -180 || longitudeMin > 180 {
+		longitudeMin = wrapLongitude(longitudeMin)
+	}
+	if longitudeMax < -180 || longitudeMax > 180 {
+		longitudeMax = wrapLongitude(longitudeMax)
+	}
+	return bounds{latitudeMin, longitudeMin, latitudeMax, longitudeMax}
+}
+
+func (b bounds) crossesAntimeridian() bool {
+	return b.longitudeMin > b.longitudeMax
+}
+
+func (b bounds) latitudeSpan() float64 {
+	return b.latitudeMax - b.latitudeMin
+}
+
+func (b bounds) longitudeSpan() float64 {
+	if b.crossesAntimeridian() {
+		return b.longitudeMax + 360 - b.longitudeMin
+	}
+	return b.longitudeMax - b.longitudeMin
+}
+
+// split returns the bounds as boxes that do not cross the antimeridian.
+func (b bounds) split() []bounds {
+	if b.crossesAntimeridian() == false {
+		return []bounds{b}
+	}
+	return []bounds{
+		{b.latitudeMin, b.longitudeMin, b.latitudeMax, 180},
+		{b.latitudeMin, -180, b.latitudeMax, b.longitudeMax},
+	}
+}
+
+func (b bounds) box() geohash.Box {
+	return geohash.Box{
+		LatitudeMin:  b.latitudeMin,
+		LongitudeMin: b.longitudeMin,
+		LatitudeMax:  b.latitudeMax,
+		LongitudeMax: b.longitudeMax,
+	}
+}
+
+func boxBounds(box geohash.Box) bounds {
+	return bounds{box.LatitudeMin, box.LongitudeMin, box.LatitudeMax, box.LongitudeMax}
+}
+
+// geohashBounds returns the area covered by a geohash cell, the geohashes
+// come from the database and are valid.
+func geohashBounds(hash string) bounds {
+	box, _ := geohash.Bounds(hash)
+	return boxBounds(box)
+}
+
+// commonGeohash returns the smallest geohash cell containing the bounds,
+// the common prefix of the geohashes of its corners.
+func (b bounds) commonGeohash() string {
+	min := geohash.GeohashFromCoordinates(b.latitudeMin, b.longitudeMin)
+	max := geohash.GeohashFromCoordinates(b.latitudeMax, b.longitudeMax)
+	commonLength := 0
+	for commonLength < len(min) && commonLength < len(max) && min[commonLength] == max[commonLength] {
+		commonLength++
+	}
+	return min[:commonLength]
+}
+
+// geohashes returns the geohashes of the given length covering the bounds,
+// the empty geohash covers the whole world.
+func (b bounds) geohashes(geohashLength int) []string {
+	return geohash.CoverBox(b.box(), geohashLength)
+}
+
+// coverCells estimates the number of cells of the given geohash length
+// covering the bounds, without enumerating them.
+func (b bounds) coverCells(geohashLength int) float64 {
+	if geohashLength == 0 {
+		return 1
+	}
+	cellSpan := 180 / math.Exp2(float64(geohashLength))
+	return (b.longitudeSpan()/cellSpan + 1) * (b.latitudeSpan()/cellSpan + 1)
+}
+
+// descendantCells returns the number of cells of the geohash length
+// toLength in a cell of the geohash length fromLength, the first digit
+// splits the world in 8 cells and the others in 4.
+func descendantCells(fromLength, toLength int) float64 {
+	if toLength <= fromLength {
+		return 1
+	}
+	n := math.Exp2(float64(2 * (toLength - fromLength)))
+	if fromLength == 0 {
+		n *= 2
+	}
+	return n
+}
+
+// coverGeohashLength returns the longest geohash length, from minLength,
+// for which the bounds are covered by at most maxCells cells.
+func (b bounds) coverGeohashLength(minLength, maxCells int) int {
+	geohashLength := minLength
+	for geohashLength < maxZoneGeohashLength && b.coverCells(geohashLength+1) <= float64(maxCells) {
+		geohashLength++
+	}
+	return geohashLength
+}
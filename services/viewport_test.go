@@ -0,0 +1,133 @@
+package services
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestNewBounds(t *testing.T) {
+	tests := []struct {
+		latitudeMin, longitudeMin, latitudeMax, longitudeMax float64
+		bounds                                               bounds
+		crossesAntimeridian                                  bool
+		longitudeSpan                                        float64
+	}{
+		{10, 20, 30, 40, bounds{10, 20, 30, 40}, false, 20},
+		// longitudes past the antimeridian are wrapped
+		{10, 170, 30, 190, bounds{10, 170, 30, -170}, true, 20},
+		{10, -190, 30, -170, bounds{10, 170, 30, -170}, true, 20},
+		{10, 170, 30, -170, bounds{10, 170, 30, -170}, true, 20},
+		// more than the whole world
+		{-90, -200, 90, 200, bounds{-90, -180, 90, 180}, false, 360},
+	}
+	for _, test := range tests {
+		b := newBounds(test.latitudeMin, test.longitudeMin, test.latitudeMax, test.longitudeMax)
+		if b != test.bounds {
+			t.Errorf("newBounds(%v, %v, %v, %v) = %v, want %v", test.latitudeMin, test.longitudeMin, test.latitudeMax, test.longitudeMax, b, test.bounds)
+			continue
+		}
+		if b.crossesAntimeridian() != test.crossesAntimeridian {
+			t.Errorf("%v crossesAntimeridian = %v", b, b.crossesAntimeridian())
+		}
+		if math.Abs(b.longitudeSpan()-test.longitudeSpan) > 1e-9 {
+			t.Errorf("%v longitudeSpan = %v, want %v", b, b.longitudeSpan(), test.longitudeSpan)
+		}
+	}
+}
+
+func TestBoundsSplit(t *testing.T) {
+	tests := []struct {
+		bounds bounds
+		split  []bounds
+	}{
+		{bounds{10, 20, 30, 40}, []bounds{{10, 20, 30, 40}}},
+		{bounds{10, 170, 30, -170}, []bounds{{10, 170, 30, 180}, {10, -180, 30, -170}}},
+	}
+	for _, test := range tests {
+		if split := test.bounds.split(); reflect.DeepEqual(split, test.split) == false {
+			t.Errorf("%v split = %v, want %v", test.bounds, split, test.split)
+		}
+	}
+}
+
+func TestBoundsGeohashes(t *testing.T) {
+	tests := []struct {
+		bounds        bounds
+		geohashLength int
+		geohashes     []string
+	}{
+		{bounds{-90, -180, 90, 180}, 0, []string{""}},
+		{bounds{-90, -180, 90, 180}, 1, []string{"0", "2", "4", "6", "1", "3", "5", "7"}},
+		{bounds{10, 10, 20, 20}, 1, []string{"5"}},
+		// both sides of the antimeridian
+		{bounds{10, 170, 20, -170}, 1, []string{"7", "1"}},
+	}
+	for _, test := range tests {
+		if geohashes := test.bounds.geohashes(test.geohashLength); reflect.DeepEqual(geohashes, test.geohashes) == false {
+			t.Errorf("%v geohashes(%d) = %v, want %v", test.bounds, test.geohashLength, geohashes, test.geohashes)
+		}
+	}
+}
+
+func TestCoverGeohashLength(t *testing.T) {
+	tests := []struct {
+		bounds   bounds
+		maxCells int
+	}{
+		{bounds{-90, -180, 90, 180}, 64},
+		{bounds{48.8, 2.2, 48.9, 2.5}, 64},
+		{bounds{10, 170, 20, -170}, 16},
+		{bounds{48.85, 2.35, 48.85, 2.35}, 4},
+	}
+	for _, test := range tests {
+		geohashLength := test.bounds.coverGeohashLength(0, test.maxCells)
+		if n := len(test.bounds.geohashes(geohashLength)); n > test.maxCells {
+			t.Errorf("%v covered by %d cells of length %d, more than %d", test.bounds, n, geohashLength, test.maxCells)
+		}
+		if geohashLength < maxZoneGeohashLength && float64(test.maxCells) >= test.bounds.coverCells(geohashLength+1) {
+			t.Errorf("%v coverGeohashLength = %d, a longer length fits %d cells", test.bounds, geohashLength, test.maxCells)
+		}
+	}
+}
+
+func TestCommonGeohash(t *testing.T) {
+	tests := []struct {
+		bounds  bounds
+		geohash string
+	}{
+		{bounds{-90, -180, 90, 180}, ""},
+		{bounds{10, 10, 20, 20}, "500"},
+		{geohashBounds("5120"), "5120"},
+	}
+	for _, test := range tests {
+		b := test.bounds
+		// the max corner of a cell belongs to its neighbours
+		b.latitudeMax -= 1e-9
+		b.longitudeMax -= 1e-9
+		if geohash := b.commonGeohash(); geohash != test.geohash {
+			t.Errorf("%v commonGeohash = %s, want %s", test.bounds, geohash, test.geohash)
+		}
+	}
+}
+
+func TestMercator(t *testing.T) {
+	tests := []struct {
+		latitude, longitude float64
+		x, y                float64
+	}{
+		{0, 0, 0.5, 0.5},
+		{0, -180, 0, 0.5},
+		{maxMercatorLatitude, 180, 1, 0},
+		{-maxMercatorLatitude, 0, 0.5, 1},
+	}
+	for _, test := range tests {
+		x, y := mercatorX(test.longitude), mercatorY(test.latitude)
+		if math.Abs(x-test.x) > 1e-9 || math.Abs(y-test.y) > 1e-9 {
+			t.Errorf("mercator(%v, %v) = %v, %v, want %v, %v", test.latitude, test.longitude, x, y, test.x, test.y)
+		}
+		if latitude := mercatorLatitude(y); math.Abs(latitude-test.latitude) > 1e-6 {
+			t.Errorf("mercatorLatitude(%v) = %v, want %v", y, latitude, test.latitude)
+		}
+	}
+}
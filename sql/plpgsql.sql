@@ -22,6 +22,7 @@ begin
       latitude,
       longitude,
       name,
+      search_name,
       provider,
       provider_id,
       version
@@ -31,6 +32,7 @@ begin
       _latitude,
       _longitude,
       _name,
+      search_text(_name),
       _provider,
       _provider_id,
       _version);
@@ -51,10 +53,9 @@ create or replace function update_point(_identifier character(50),
 declare
   _new_geohash character varying;
   _list_id integer;
-  _list_ids integer[];
   _row record;
 begin
-  select point.id as point_id, point.geohash into _row from point where point.identifier = _identifier;
+  select point.id as point_id, point.geohash, point.latitude, point.longitude into _row from point where point.identifier = _identifier;
   if not found then
     raise exception 'Identifier lookup failed';
   end if;
@@ -62,26 +63,31 @@ begin
   select coalesce(_geohash, _row.geohash) into _new_geohash;
   update point
   set name = coalesce(_name, name),
+    search_name = search_text(coalesce(_name, name)),
     latitude = coalesce(_latitude, latitude),
     longitude = coalesce(_longitude, longitude),
     geohash = _new_geohash
   where identifier = _identifier;
 
-  if _new_geohash != _row.geohash then
-
-    select array_agg(list_id) into _list_ids from list_point where list_point.point_id = _row.point_id group by list_id;
-    foreach _list_id in array _list_ids
-    loop
-      perform _remove_point_from_list(_row.point_id, _identifier, _row.geohash, _list_id, _no_event);
-    end loop;
-    foreach _list_id in array _list_ids
+  --- the zones keep the sums of the coordinates, moving a point inside its
+  --- geohash changes them too, the zones are updated in place so the point
+  --- keeps its list_point rows and its position in the pages of the lists
+  if _new_geohash != _row.geohash or coalesce(_latitude, _row.latitude) != _row.latitude or coalesce(_longitude, _row.longitude) != _row.longitude then
+    for _list_id in select list_id from list_point where list_point.point_id = _row.point_id
     loop
-      perform _add_point_to_list(_row.point_id, _identifier, _list_id, _new_geohash, _latitude, _longitude, _no_event);
+      perform remove_geohash_from_list(_list_id, _row.geohash, _row.latitude, _row.longitude);
+      perform add_geohash_to_list(_list_id, _new_geohash, coalesce(_latitude, _row.latitude), coalesce(_longitude, _row.longitude));
+      --- the validators of the geohash the point left change too
+      if _no_event = false and _new_geohash != _row.geohash then
+        perform create_event(_list_id, _row.geohash, 7, _identifier, null);
+      end if;
     end loop;
   end if;
 
   if _no_event = false then
     perform create_event_for_point(_identifier, 7);
+  else
+    perform touch_list(list_id) from list_point where list_point.point_id = _row.point_id;
   end if;
 end;
 $$ language plpgsql;
@@ -92,17 +98,16 @@ $$ language plpgsql;
 create or replace function delete_point(_identifier character(50)) returns void as $$
 declare
   _list_id integer;
-  _list_ids integer[];
   _row record;
 begin
-  select point.id as point_id, point.geohash into _row from point where point.identifier = _identifier;
+  select point.id as point_id, point.geohash, point.latitude, point.longitude into _row from point where point.identifier = _identifier;
   if not found then
     raise exception 'Identifier lookup failed';
   end if;
-  select array_agg(list_id) into _list_ids from list_point where list_point.point_id = _row.point_id group by list_id;
+  select coalesce(array_agg(list_id), '{}') into _list_ids from list_point where list_point.point_id = _row.point_id;
   foreach _list_id in array _list_ids
   loop
-    perform _remove_point_from_list(_row.point_id, _identifier, _row.geohash, _list_id, false);
+    perform _remove_point_from_list(_row.point_id, _identifier, _row.geohash, _row.latitude, _row.longitude, _list_id, false);
   end loop;
 
   delete FROM point WHERE identifier = _identifier;
@@ -141,6 +146,10 @@ begin
   insert into point_meta (identifier, point_id, list_id, uid, action, content) values (_identifier, _point_id, _list_id, _uid, _action, _content::jsonb);
   if not _no_event then
     perform create_event_for_point_meta(_identifier, _point_identifier, 9);
+  elsif _list_id is not null then
+    perform touch_list(_list_id);
+  else
+    perform touch_list(list_id) from list_point where list_point.point_id = _point_id;
   end if;
 end;
 $$ language plpgsql;
@@ -181,6 +190,70 @@ $$ language plpgsql;
 
 
 
+--- zone_min_level
+--- the shortest geohash length stored in list_zone
+create or replace function zone_min_level() returns integer as $$
+  select 1;
+$$ language sql immutable;
+
+
+
+
+--- zone_max_level
+--- the longest geohash length stored in list_zone
+create or replace function zone_max_level() returns integer as $$
+  select 17;
+$$ language sql immutable;
+
+
+
+
+--- zone_levels
+create or replace function zone_levels() returns setof integer as $$
+  select generate_series(zone_min_level(), zone_max_level());
+$$ language sql immutable;
+
+
+
+
+--- touch_list
+--- changes without events still change the validators of the list
+create or replace function touch_list(_list_id integer) returns void as $$
+begin
+  update list set last_update = now() where id = _list_id;
+end;
+$$ language plpgsql;
+
+
+
+
+--- get_list_validator
+--- the last update of the list, and the last event of the list for its
+--- whole content or for the points under one of the geohashes
+create or replace function get_list_validator(_identifier character(50),
+                        _geohashes character varying array)
+               returns table (last_update timestamp with time zone,
+                      last_event_id integer,
+                      last_event_date timestamp with time zone)
+               as $$
+declare
+  _list_id integer;
+  _last_update timestamp with time zone;
+begin
+  select list.id, list.last_update into _list_id, _last_update from list where list.identifier = _identifier;
+  if not found then
+    raise exception 'Identifier lookup failed';
+  end if;
+  return query select _last_update, coalesce(max(event.id), 0), coalesce(max(event.date_created), _last_update)
+    from event
+    where event.list_id = _list_id
+    and (event.geohash is null or event.geohash like any (select g || '%' from unnest(_geohashes) as g));
+end;
+$$ language plpgsql;
+
+
+
+
 --- get_list_point
 create or replace function get_list_point(_identifier character(50),
                       _geohash character,
@@ -224,6 +297,277 @@ $$ language plpgsql;
 
 
 
+--- get_list_point_page
+--- the points after the (_after_date, _after_id) cursor, ordered by date
+--- of addition to the list then by id
+create or replace function get_list_point_page(_identifier character(50),
+                      _geohash character,
+                      _exclude_geohash character varying array,
+                      _after_date timestamp with time zone,
+                      _after_id integer,
+                      _limit integer)
+               returns table (id integer,
+                      identifier character(50),
+                      latitude numeric,
+                      longitude numeric,
+                      name character varying,
+                      provider character varying,
+                      provider_id character varying,
+                      date_created timestamp with time zone)
+               as $$
+declare
+  _list_id integer;
+begin
+  select list.id into _list_id from list where list.identifier = _identifier;
+  if not found then
+    raise exception 'Identifier lookup failed';
+  end if;
+  return query select point.id,
+            point.identifier,
+            point.latitude,
+            point.longitude,
+            point.name,
+            point.provider,
+            point.provider_id,
+            list_point.date_created
+    from point
+    inner join list_point on (list_point.point_id = point.id and list_point.list_id = _list_id)
+    where (geohash similar to _geohash || '%')
+    and not geohash like any (select * from unnest(_exclude_geohash))
+    and (list_point.date_created, point.id) > (_after_date, _after_id)
+    order by list_point.date_created, point.id
+    limit _limit;
+end;
+$$ language plpgsql;
+
+
+
+
+--- get_list_point_nearby
+--- the _limit points of the _geohash cells closest to _latitude/_longitude,
+--- ordered by great-circle distance, closer than _radius metres when it is
+--- not null
+create or replace function get_list_point_nearby(_identifier character(50),
+                      _geohash character,
+                      _latitude double precision,
+                      _longitude double precision,
+                      _radius double precision,
+                      _limit integer)
+               returns table (id integer,
+                      identifier character(50),
+                      latitude numeric,
+                      longitude numeric,
+                      name character varying,
+                      provider character varying,
+                      provider_id character varying,
+                      date_created timestamp with time zone)
+               as $$
+declare
+  _list_id integer;
+begin
+  select list.id into _list_id from list where list.identifier = _identifier;
+  if not found then
+    raise exception 'Identifier lookup failed';
+  end if;
+  return query select t.id, t.identifier, t.latitude, t.longitude, t.name, t.provider, t.provider_id, t.date_created
+    from (select point.id,
+            point.identifier,
+            point.latitude,
+            point.longitude,
+            point.name,
+            point.provider,
+            point.provider_id,
+            list_point.date_created,
+            2 * 6371008.8 * asin(least(1, sqrt(power(sin(radians(point.latitude::double precision - _latitude) / 2), 2)
+              + cos(radians(_latitude)) * cos(radians(point.latitude::double precision))
+              * power(sin(radians(point.longitude::double precision - _longitude) / 2), 2)))) as distance
+    from point
+    inner join list_point on (list_point.point_id = point.id and list_point.list_id = _list_id)
+    where (geohash similar to _geohash || '%')) as t
+    where _radius is null or t.distance <= _radius
+    order by t.distance, t.id
+    limit _limit;
+end;
+$$ language plpgsql;
+
+
+
+
+--- get_list_zone_counts
+--- the number of points of the list in the _geohashes zones, by level
+create or replace function get_list_zone_counts(_identifier character(50),
+                      _geohashes character varying array)
+               returns table (level integer,
+                      n_points bigint)
+               as $$
+declare
+  _list_id integer;
+begin
+  select list.id into _list_id from list where list.identifier = _identifier;
+  if not found then
+    raise exception 'Identifier lookup failed';
+  end if;
+  return query select z.level, sum(z.n_points)::bigint
+    from list_zone z
+    where z.list_id = _list_id and z.geohash = any(_geohashes)
+    group by z.level;
+end;
+$$ language plpgsql;
+
+
+
+
+--- get_list_cluster_points
+create or replace function get_list_cluster_points(_identifier character(50),
+                      _geohash character,
+                      _limit integer,
+                      _offset integer)
+               returns table (id integer,
+                      identifier character(50),
+                      latitude numeric,
+                      longitude numeric,
+                      name character varying,
+                      provider character varying,
+                      provider_id character varying,
+                      date_created timestamp with time zone)
+               as $$
+declare
+  _list_id integer;
+begin
+  select list.id into _list_id from list where list.identifier = _identifier;
+  if not found then
+    raise exception 'Identifier lookup failed';
+  end if;
+  return query select point.id,
+            point.identifier,
+            point.latitude,
+            point.longitude,
+            point.name,
+            point.provider,
+            point.provider_id,
+            list_point.date_created
+    from point
+    inner join list_point on (list_point.point_id = point.id and list_point.list_id = _list_id)
+    where geohash like _geohash || '%'
+    order by point.id
+    limit _limit offset _offset;
+end;
+$$ language plpgsql;
+
+
+
+
+--- search_text
+--- the text without accents, lower case, with its words separated by single
+--- spaces, and a leading space so that words match ' ' || prefix || '%'
+create or replace function search_text(_text character varying) returns text as $$
+  select ' ' || trim(regexp_replace(lower(unaccent(_text)), '[^[:alnum:]]+', ' ', 'g'));
+$$ language sql stable;
+
+
+
+
+--- search_list_points
+--- all the words of the query must start a word of the name of the point,
+--- or of the _fields of the contents of its metas, the points are ranked
+--- with 3 when the name starts with the query, 2 when the name matches,
+--- 1 when the metas match, then by distance to _latitude/_longitude when
+--- they are not null
+--- the names are matched on the search_name column, the documents of the
+--- metas are only built for the points of the geohash and the viewport
+--- whose name does not match
+create or replace function search_list_points(_identifier character(50),
+                      _query character varying,
+                      _fields character varying array,
+                      _geohash character,
+                      _latitude_min numeric,
+                      _longitude_min numeric,
+                      _latitude_max numeric,
+                      _longitude_max numeric,
+                      _latitude numeric,
+                      _longitude numeric,
+                      _limit integer)
+               returns table (id integer,
+                      identifier character(50),
+                      latitude numeric,
+                      longitude numeric,
+                      name character varying,
+                      provider character varying,
+                      provider_id character varying,
+                      date_created timestamp with time zone,
+                      rank integer)
+               as $$
+declare
+  _list_id integer;
+  _text text;
+  _words text array;
+  _pattern text;
+begin
+  select list.id into _list_id from list where list.identifier = _identifier;
+  if not found then
+    raise exception 'Identifier lookup failed';
+  end if;
+  _text := search_text(_query);
+  select coalesce(array_agg(w), '{}') into _words from regexp_split_to_table(trim(_text), ' ') as w where w <> '';
+  if array_length(_words, 1) is null then
+    return;
+  end if;
+
+  --- without fields only the names can match, the longest word narrows the
+  --- points with the trigram index of search_name
+  _pattern := '%';
+  if array_length(_fields, 1) is null then
+    select '% ' || w || '%' into _pattern from unnest(_words) as w order by length(w) desc limit 1;
+  end if;
+
+  return query select * from (select c.id,
+            c.identifier,
+            c.latitude,
+            c.longitude,
+            c.name,
+            c.provider,
+            c.provider_id,
+            c.date_created,
+            (case when c.search_name like _text || '%' then 3
+                  when c.name_match then 2
+                  else 1 end) as rank
+    from (select point.id,
+            point.identifier,
+            point.latitude,
+            point.longitude,
+            point.name,
+            point.search_name,
+            point.provider,
+            point.provider_id,
+            list_point.date_created,
+            not exists (select 1 from unnest(_words) as w where point.search_name not like '% ' || w || '%') as name_match
+      from point
+      inner join list_point on (list_point.point_id = point.id and list_point.list_id = _list_id)
+      where (point.geohash similar to _geohash || '%')
+      and point.latitude between _latitude_min and _latitude_max
+      and (case when _longitude_min <= _longitude_max then point.longitude between _longitude_min and _longitude_max
+                else point.longitude >= _longitude_min or point.longitude <= _longitude_max end)
+      and point.search_name like _pattern
+      --- keeps the filters above out of the match on the metas below
+      offset 0) as c
+    cross join lateral (select (case when c.name_match or array_length(_fields, 1) is null then null
+            else c.search_name || coalesce((select string_agg(search_text(point_meta.content->>f), '')
+              from point_meta, unnest(_fields) as f
+              where point_meta.point_id = c.id and (point_meta.list_id = _list_id or point_meta.list_id is null)
+              and point_meta.content ? f), '') end) as document) as d
+    where c.name_match
+    or (d.document is not null and not exists (select 1 from unnest(_words) as w where d.document not like '% ' || w || '%'))) as t
+    order by t.rank desc,
+      (case when _latitude is null then 0
+            else power(t.latitude - _latitude, 2) + power((t.longitude - _longitude) * cos(radians(_latitude)), 2) end),
+      t.name, t.id
+    limit _limit;
+end;
+$$ language plpgsql;
+
+
+
+
 --- get_points_for_events
 create or replace function get_points_for_events(_event_ids integer array)
                returns table (id integer,
@@ -366,11 +710,20 @@ $$ language plpgsql;
 
 
 --- get_list_geohash_zones
-create or replace function get_list_geohash_zones(_identifier character(50), _max_points integer)
+--- the zones between _min_level and _max_level, the deepest ones at most at
+--- level 15
+create or replace function get_list_geohash_zones(_identifier character(50),
+                        _max_points integer,
+                        _min_level integer,
+                        _max_level integer)
                returns table (geohash character,
                       n_points integer,
                       avg_latitude numeric(30,27),
-                      avg_longitude numeric(30,27))
+                      avg_longitude numeric(30,27),
+                      min_latitude numeric(30,27),
+                      min_longitude numeric(30,27),
+                      max_latitude numeric(30,27),
+                      max_longitude numeric(30,27))
                as $$
 declare
   _list_id integer;
@@ -379,40 +732,11 @@ begin
   if not found then
     raise exception 'Identifier lookup failed';
   end if;
-  return query select geohash, n_points, avg_latitude, avg_longitude from (
-    select list_geohash_625000.geohash, list_geohash_625000.n_points, 625000 as geohash_size, avg_latitude, avg_longitude
-    from list_geohash_625000 where list_geohash_625000.list_id = _list_id and list_geohash_625000.n_points <= _max_points
-  union all
-    select list_geohash_312000.geohash, list_geohash_312000.n_points, 312000 as geohash_size, avg_latitude, avg_longitude
-    from list_geohash_312000 where list_geohash_312000.list_id = _list_id and list_geohash_312000.n_points <= _max_points
-  union all
-    select list_geohash_156000.geohash, list_geohash_156000.n_points, 156000 as geohash_size, avg_latitude, avg_longitude
-    from list_geohash_156000 where list_geohash_156000.list_id = _list_id and list_geohash_156000.n_points <= _max_points
-  union all
-    select list_geohash_80000.geohash, list_geohash_80000.n_points, 80000 as geohash_size, avg_latitude, avg_longitude
-    from list_geohash_80000 where list_geohash_80000.list_id = _list_id and list_geohash_80000.n_points <= _max_points
-  union all
-    select list_geohash_40000.geohash, list_geohash_40000.n_points, 40000 as geohash_size, avg_latitude, avg_longitude
-    from list_geohash_40000 where list_geohash_40000.list_id = _list_id and list_geohash_40000.n_points <= _max_points
-  union all
-    select list_geohash_20000.geohash, list_geohash_20000.n_points, 20000 as geohash_size, avg_latitude, avg_longitude
-    from list_geohash_20000 where list_geohash_20000.list_id = _list_id and list_geohash_20000.n_points <= _max_points
-  union all
-    select list_geohash_9600.geohash, list_geohash_9600.n_points, 9600 as geohash_size, avg_latitude, avg_longitude
-    from list_geohash_9600 where list_geohash_9600.list_id = _list_id and list_geohash_9600.n_points <= _max_points
-  union all
-    select list_geohash_4800.geohash, list_geohash_4800.n_points, 4800 as geohash_size, avg_latitude, avg_longitude
-    from list_geohash_4800 where list_geohash_4800.list_id = _list_id and list_geohash_4800.n_points <= _max_points
-  union all
-    select list_geohash_2400.geohash, list_geohash_2400.n_points, 2400 as geohash_size, avg_latitude, avg_longitude
-    from list_geohash_2400 where list_geohash_2400.list_id = _list_id and list_geohash_2400.n_points <= _max_points
-  union all
-    select list_geohash_1200.geohash, list_geohash_1200.n_points, 1200 as geohash_size, avg_latitude, avg_longitude
-    from list_geohash_1200 where list_geohash_1200.list_id = _list_id and list_geohash_1200.n_points <= _max_points
-  union all
-    select list_geohash_600.geohash, list_geohash_600.n_points, 600 as geohash_size, avg_latitude, avg_longitude
-    from list_geohash_600 where list_geohash_600.list_id = _list_id
-  ) as t order by geohash_size desc;
+  return query select z.geohash::bpchar, z.n_points, (z.sum_latitude / z.n_points)::numeric(30,27), (z.sum_longitude / z.n_points)::numeric(30,27),
+            z.min_latitude, z.min_longitude, z.max_latitude, z.max_longitude
+    from list_zone z where z.list_id = _list_id and z.level between _min_level and least(_max_level, 15)
+    and (z.n_points <= _max_points or z.level = least(_max_level, 15))
+    order by z.level;
 end;
 $$ language plpgsql;
 
@@ -420,13 +744,21 @@ $$ language plpgsql;
 
 
 --- get_list_geohash_zones_for_point
+--- the zones of the point between _min_level and _max_level, the deepest
+--- one at most at level 15
 create or replace function get_list_geohash_zones_for_point(_identifier character(50),
                                 _point_identifier character(50),
-                                _max_points integer)
+                                _max_points integer,
+                                _min_level integer,
+                                _max_level integer)
                returns table (geohash character,
                       n_points integer,
                       avg_latitude numeric(30,27),
-                      avg_longitude numeric(30,27))
+                      avg_longitude numeric(30,27),
+                      min_latitude numeric(30,27),
+                      min_longitude numeric(30,27),
+                      max_latitude numeric(30,27),
+                      max_longitude numeric(30,27))
                as $$
 declare
   _list_id integer;
@@ -440,40 +772,12 @@ begin
   if not found then
     raise exception 'Point identifier lookup failed';
   end if;
-  return query select geohash, n_points, avg_latitude, avg_longitude from (
-    select list_geohash_625000.geohash, list_geohash_625000.n_points, 625000 as geohash_size, avg_latitude, avg_longitude
-    from list_geohash_625000 where list_geohash_625000.geohash = substring(_point_row.geohash for 5) and list_geohash_625000.list_id = _list_id and list_geohash_625000.n_points <= _max_points
-  union all
-    select list_geohash_312000.geohash, list_geohash_312000.n_points, 312000 as geohash_size, avg_latitude, avg_longitude
-    from list_geohash_312000 where list_geohash_312000.geohash = substring(_point_row.geohash for 6) and list_geohash_312000.list_id = _list_id and list_geohash_312000.n_points <= _max_points
-  union all
-    select list_geohash_156000.geohash, list_geohash_156000.n_points, 156000 as geohash_size, avg_latitude, avg_longitude
-    from list_geohash_156000 where list_geohash_156000.geohash = substring(_point_row.geohash for 7) and list_geohash_156000.list_id = _list_id and list_geohash_156000.n_points <= _max_points
-  union all
-    select list_geohash_80000.geohash, list_geohash_80000.n_points, 80000 as geohash_size, avg_latitude, avg_longitude
-    from list_geohash_80000 where list_geohash_80000.geohash = substring(_point_row.geohash for 8) and list_geohash_80000.list_id = _list_id and list_geohash_80000.n_points <= _max_points
-  union all
-    select list_geohash_40000.geohash, list_geohash_40000.n_points, 40000 as geohash_size, avg_latitude, avg_longitude
-    from list_geohash_40000 where list_geohash_40000.geohash = substring(_point_row.geohash for 9) and list_geohash_40000.list_id = _list_id and list_geohash_40000.n_points <= _max_points
-  union all
-    select list_geohash_20000.geohash, list_geohash_20000.n_points, 20000 as geohash_size, avg_latitude, avg_longitude
-    from list_geohash_20000 where list_geohash_20000.geohash = substring(_point_row.geohash for 10) and list_geohash_20000.list_id = _list_id and list_geohash_20000.n_points <= _max_points
-  union all
-    select list_geohash_9600.geohash, list_geohash_9600.n_points, 9600 as geohash_size, avg_latitude, avg_longitude
-    from list_geohash_9600 where list_geohash_9600.geohash = substring(_point_row.geohash for 11) and list_geohash_9600.list_id = _list_id and list_geohash_9600.n_points <= _max_points
-  union all
-    select list_geohash_4800.geohash, list_geohash_4800.n_points, 4800 as geohash_size, avg_latitude, avg_longitude
-    from list_geohash_4800 where list_geohash_4800.geohash = substring(_point_row.geohash for 12) and list_geohash_4800.list_id = _list_id and list_geohash_4800.n_points <= _max_points
-  union all
-    select list_geohash_2400.geohash, list_geohash_2400.n_points, 2400 as geohash_size, avg_latitude, avg_longitude
-    from list_geohash_2400 where list_geohash_2400.geohash = substring(_point_row.geohash for 13) and list_geohash_2400.list_id = _list_id and list_geohash_2400.n_points <= _max_points
-  union all
-    select list_geohash_1200.geohash, list_geohash_1200.n_points, 1200 as geohash_size, avg_latitude, avg_longitude
-    from list_geohash_1200 where list_geohash_1200.geohash = substring(_point_row.geohash for 14) and list_geohash_1200.list_id = _list_id and list_geohash_1200.n_points <= _max_points
-  union all
-    select list_geohash_600.geohash, list_geohash_600.n_points, 600 as geohash_size, avg_latitude, avg_longitude
-    from list_geohash_600 where list_geohash_600.geohash = substring(_point_row.geohash for 15) and list_geohash_600.list_id = _list_id
-  ) as t order by geohash_size desc;
+  return query select z.geohash::bpchar, z.n_points, (z.sum_latitude / z.n_points)::numeric(30,27), (z.sum_longitude / z.n_points)::numeric(30,27),
+            z.min_latitude, z.min_longitude, z.max_latitude, z.max_longitude
+    from list_zone z where z.list_id = _list_id and z.level between _min_level and least(_max_level, 15)
+    and (z.n_points <= _max_points or z.level = least(_max_level, 15))
+    and (z.level, z.geohash) in (select l, substring(_point_row.geohash for l) from zone_levels() as l)
+    order by z.level;
 end;
 $$ language plpgsql;
 
@@ -486,9 +790,13 @@ create or replace function get_zone_tree_level(_identifier character(50),
                          _from_nodes character array,
                          _from_nodes_size integer)
                returns table (geohash character,
-                            n_points integer,
-                            avg_latitude numeric(30,27),
-                            avg_longitude numeric(30,27))
+                      n_points integer,
+                      avg_latitude numeric(30,27),
+                      avg_longitude numeric(30,27),
+                      min_latitude numeric(30,27),
+                      min_longitude numeric(30,27),
+                      max_latitude numeric(30,27),
+                      max_longitude numeric(30,27))
                as $$
 declare
   _list_id integer;
@@ -497,59 +805,11 @@ begin
   if not found then
     raise exception 'List identifier lookup failed';
   end if;
-  if _geohash_length <= 5 then
-  return query select l.geohash, l.n_points, l.avg_latitude, l.avg_longitude
-          from list_geohash_625000 l where list_id = _list_id
-          and substring(l.geohash for _from_nodes_size) in (select * from unnest(_from_nodes));
-  elsif _geohash_length = 6 then
-  return query select l.geohash, l.n_points, l.avg_latitude, l.avg_longitude
-          from list_geohash_312000 l where list_id = _list_id
-          and substring(l.geohash for _from_nodes_size) in (select * from unnest(_from_nodes));
-  elsif _geohash_length = 7 then
-  return query select l.geohash, l.n_points, l.avg_latitude, l.avg_longitude
-          from list_geohash_156000 l where list_id = _list_id
-          and substring(l.geohash for _from_nodes_size) in (select * from unnest(_from_nodes));
-  elsif _geohash_length = 8 then
-  return query select l.geohash, l.n_points, l.avg_latitude, l.avg_longitude
-          from list_geohash_80000 l where list_id = _list_id
-          and substring(l.geohash for _from_nodes_size) in (select * from unnest(_from_nodes));
-  elsif _geohash_length = 9 then
-  return query select l.geohash, l.n_points, l.avg_latitude, l.avg_longitude
-          from list_geohash_40000 l where list_id = _list_id
-          and substring(l.geohash for _from_nodes_size) in (select * from unnest(_from_nodes));
-  elsif _geohash_length = 10 then
-  return query select l.geohash, l.n_points, l.avg_latitude, l.avg_longitude
-          from list_geohash_20000 l where list_id = _list_id
-          and substring(l.geohash for _from_nodes_size) in (select * from unnest(_from_nodes));
-  elsif _geohash_length = 11 then
-  return query select l.geohash, l.n_points, l.avg_latitude, l.avg_longitude
-          from list_geohash_9600 l where list_id = _list_id
-          and substring(l.geohash for _from_nodes_size) in (select * from unnest(_from_nodes));
-  elsif _geohash_length = 12 then
-  return query select l.geohash, l.n_points, l.avg_latitude, l.avg_longitude
-          from list_geohash_4800 l where list_id = _list_id
-          and substring(l.geohash for _from_nodes_size) in (select * from unnest(_from_nodes));
-  elsif _geohash_length = 13 then
-  return query select l.geohash, l.n_points, l.avg_latitude, l.avg_longitude
-          from list_geohash_2400 l where list_id = _list_id
-          and substring(l.geohash for _from_nodes_size) in (select * from unnest(_from_nodes));
-  elsif _geohash_length = 14 then
-  return query select l.geohash, l.n_points, l.avg_latitude, l.avg_longitude
-          from list_geohash_1200 l where list_id = _list_id
-          and substring(l.geohash for _from_nodes_size) in (select * from unnest(_from_nodes));
-  elsif _geohash_length = 15 then
-  return query select l.geohash, l.n_points, l.avg_latitude, l.avg_longitude
-          from list_geohash_600 l where list_id = _list_id
-          and substring(l.geohash for _from_nodes_size) in (select * from unnest(_from_nodes));
-  elsif _geohash_length = 16 then
-  return query select l.geohash, l.n_points, l.avg_latitude, l.avg_longitude
-          from list_geohash_300 l where list_id = _list_id
-          and substring(l.geohash for _from_nodes_size) in (select * from unnest(_from_nodes));
-  elsif _geohash_length >= 17 then
-  return query select l.geohash, l.n_points, l.avg_latitude, l.avg_longitude
-          from list_geohash l where list_id = _list_id
-          and substring(l.geohash for _from_nodes_size) in (select * from unnest(_from_nodes));
-  end if;
+  return query select z.geohash::bpchar, z.n_points, (z.sum_latitude / z.n_points)::numeric(30,27), (z.sum_longitude / z.n_points)::numeric(30,27),
+            z.min_latitude, z.min_longitude, z.max_latitude, z.max_longitude
+    from list_zone z where z.list_id = _list_id
+    and z.level = least(greatest(_geohash_length, zone_min_level()), zone_max_level())
+    and substring(z.geohash for _from_nodes_size) in (select * from unnest(_from_nodes));
 end;
 $$ language plpgsql;
 
@@ -566,7 +826,7 @@ create or replace function get_lists_aroundme(_geohashes character array)
 begin
   return query select distinct list.identifier, list.name, list.icon, list.n_installs
     from list
-    inner join list_geohash_20000 on (list_geohash_20000.list_id = list.id and list_geohash_20000.geohash in (select * from unnest(_geohashes)))
+    inner join list_zone on (list_zone.list_id = list.id and list_zone.level = 10 and list_zone.geohash in (select * from unnest(_geohashes)))
     where is_public = true;
 end;
 $$ language plpgsql;
@@ -624,10 +884,23 @@ $$ language plpgsql;
 --- update_list
 create or replace function update_list(_identifier character(50),
                      _name character(50),
-                    _icon character(50))
+                     _icon character(50),
+                     _expand_threshold integer,
+                     _max_zone_points integer,
+                     _min_geohash_length integer,
+                     _max_geohash_length integer,
+                     _cluster_engine character varying)
                returns void as $$
 begin
-  update list set name = coalesce(_name, name), icon = coalesce(_icon, icon) where identifier = _identifier;
+  update list set name = coalesce(_name, name),
+    icon = coalesce(_icon, icon),
+    expand_threshold = coalesce(_expand_threshold, expand_threshold),
+    max_zone_points = coalesce(_max_zone_points, max_zone_points),
+    min_geohash_length = coalesce(_min_geohash_length, min_geohash_length),
+    max_geohash_length = coalesce(_max_geohash_length, max_geohash_length),
+    cluster_engine = coalesce(_cluster_engine, cluster_engine),
+    last_update = now()
+  where identifier = _identifier;
   perform create_event_for_list(_identifier, 1);
 end;
 $$ language plpgsql;
@@ -635,6 +908,90 @@ $$ language plpgsql;
 
 
 
+--- get_list_cluster_settings
+create or replace function get_list_cluster_settings(_identifier character(50))
+               returns table (expand_threshold integer,
+                      max_zone_points integer,
+                      min_geohash_length integer,
+                      max_geohash_length integer,
+                      cluster_engine character varying)
+               as $$
+begin
+  return query select list.expand_threshold,
+            list.max_zone_points,
+            list.min_geohash_length,
+            list.max_geohash_length,
+            list.cluster_engine
+    from list
+    where list.identifier = _identifier;
+  if not found then
+    raise exception 'Identifier lookup failed';
+  end if;
+end;
+$$ language plpgsql;
+
+
+
+
+--- get_list_index_state
+--- the version of the in memory index of the list, changes without events
+--- only update last_update
+create or replace function get_list_index_state(_identifier character(50))
+               returns table (last_event_id integer,
+                      last_update timestamp with time zone,
+                      n_points bigint)
+               as $$
+declare
+  _list_id integer;
+begin
+  select list.id into _list_id from list where list.identifier = _identifier;
+  if not found then
+    raise exception 'Identifier lookup failed';
+  end if;
+  return query select (select coalesce(max(event.id), 0) from event where event.list_id = _list_id),
+            (select list.last_update from list where list.id = _list_id),
+            (select count(*) from list_point where list_point.list_id = _list_id);
+end;
+$$ language plpgsql;
+
+
+
+
+--- get_list_points_for_index
+create or replace function get_list_points_for_index(_identifier character(50))
+               returns table (id integer,
+                      identifier character(50),
+                      latitude numeric,
+                      longitude numeric,
+                      name character varying,
+                      provider character varying,
+                      provider_id character varying,
+                      date_created timestamp with time zone)
+               as $$
+declare
+  _list_id integer;
+begin
+  select list.id into _list_id from list where list.identifier = _identifier;
+  if not found then
+    raise exception 'Identifier lookup failed';
+  end if;
+  return query select point.id,
+            point.identifier,
+            point.latitude,
+            point.longitude,
+            point.name,
+            point.provider,
+            point.provider_id,
+            list_point.date_created
+    from point
+    inner join list_point on (list_point.point_id = point.id and list_point.list_id = _list_id)
+    order by point.id;
+end;
+$$ language plpgsql;
+
+
+
+
 --- add_point_to_list
 create or replace function add_point_to_list(_point_identifier character(50),
                          _list_identifier character(50),
@@ -677,6 +1034,8 @@ begin
   perform add_geohash_to_list(_list_id, _geohash, _latitude, _longitude);
   if not _no_event then
     perform create_event(_list_id, _geohash, 5, _point_identifier, null);
+  else
+    perform touch_list(_list_id);
   end if;
 end;
 $$ language plpgsql;
@@ -693,7 +1052,7 @@ declare
   _row record;
   _list_id integer;
 begin
-  select id as point_id, geohash into _row from point where identifier = _point_identifier;
+  select id as point_id, geohash, latitude, longitude into _row from point where identifier = _point_identifier;
   if not found then
     raise exception 'Identifier lookup failed';
   end if;
@@ -704,7 +1063,7 @@ begin
   if not exists(select 1 from list_point where list_id = _list_id and point_id = _row.point_id) then
     return;
   end if;
-  perform _remove_point_from_list(_row.point_id, _point_identifier, _row.geohash, _list_id, _no_event);
+  perform _remove_point_from_list(_row.point_id, _point_identifier, _row.geohash, _row.latitude, _row.longitude, _list_id, _no_event);
 end;
 $$ language plpgsql;
 
@@ -715,15 +1074,19 @@ $$ language plpgsql;
 create or replace function _remove_point_from_list(_point_id integer,
                            _point_identifier character(50),
                            _geohash character varying,
+                           _latitude numeric(30,27),
+                           _longitude numeric(30,27),
                            _list_id integer,
                            _no_event boolean)
                returns void as $$
 begin
   delete from list_point where list_id = _list_id and point_id = _point_id;
-  perform remove_geohash_from_list(_list_id, _geohash);
+  perform remove_geohash_from_list(_list_id, _geohash, _latitude, _longitude);
   delete from event where list_id = _list_id and object_identifier = _point_identifier;
   if not _no_event then
     perform create_event(_list_id, _geohash, 6, _point_identifier, null);
+  else
+    perform touch_list(_list_id);
   end if;
 end;
 $$ language plpgsql;
@@ -736,320 +1099,182 @@ create or replace function add_geohash_to_list(_list_id integer,
                            _latitude numeric(30,27),
                            _longitude numeric(30,27))
                returns void as $$
-declare
-  _geohash_id integer;
-  _sub_geohash character varying;
 begin
-  select _geohash into _sub_geohash;
-  select id into _geohash_id from list_geohash where geohash = _sub_geohash and list_id = _list_id;
-  if not found then
-    begin
-      insert into list_geohash (list_id, geohash, n_points, avg_latitude, avg_longitude) values (_list_id, _sub_geohash, 1, _latitude, _longitude);
-    exception when others then
-      update list_geohash set n_points=n_points+1,
-                  avg_latitude = (avg_latitude * n_points + _latitude) / (n_points + 1),
-                  avg_longitude = (avg_longitude * n_points + _longitude) / (n_points + 1)
-      where list_id = _list_id and geohash = _sub_geohash;
-    end;
-  else
-    update list_geohash set n_points=n_points+1,
-            avg_latitude = (avg_latitude * n_points + _latitude) / (n_points + 1),
-            avg_longitude = (avg_longitude * n_points + _longitude) / (n_points + 1)
-    where list_id = _list_id and geohash = _sub_geohash;
-  end if;
+  insert into list_zone (list_id, level, geohash, n_points, sum_latitude, sum_longitude, min_latitude, min_longitude, max_latitude, max_longitude)
+    select _list_id, l, substring(_geohash for l), 1, _latitude, _longitude, _latitude, _longitude, _latitude, _longitude
+    from zone_levels() as l
+  on conflict (list_id, level, geohash) do update set n_points = list_zone.n_points + 1,
+    sum_latitude = list_zone.sum_latitude + excluded.sum_latitude,
+    sum_longitude = list_zone.sum_longitude + excluded.sum_longitude,
+    min_latitude = least(list_zone.min_latitude, excluded.min_latitude),
+    min_longitude = least(list_zone.min_longitude, excluded.min_longitude),
+    max_latitude = greatest(list_zone.max_latitude, excluded.max_latitude),
+    max_longitude = greatest(list_zone.max_longitude, excluded.max_longitude);
+end;
+$$ language plpgsql;
 
-  select substring(_geohash for 16) into _sub_geohash;
-  select id into _geohash_id from list_geohash_300 where geohash = _sub_geohash and list_id = _list_id;
-  if not found then
-    begin
-      insert into list_geohash_300 (list_id, geohash, n_points, avg_latitude, avg_longitude) values (_list_id, _sub_geohash, 1, _latitude, _longitude);
-    exception when others then
-      update list_geohash_300 set n_points=n_points+1,
-            avg_latitude = (avg_latitude * n_points + _latitude) / (n_points + 1),
-            avg_longitude = (avg_longitude * n_points + _longitude) / (n_points + 1)
-      where list_id = _list_id and geohash = _sub_geohash;
-    end;
-  else
-    update list_geohash_300 set n_points=n_points+1,
-            avg_latitude = (avg_latitude * n_points + _latitude) / (n_points + 1),
-            avg_longitude = (avg_longitude * n_points + _longitude) / (n_points + 1)
-    where list_id = _list_id and geohash = _sub_geohash;
-  end if;
 
-  select substring(_geohash for 15) into _sub_geohash;
-  select id into _geohash_id from list_geohash_600 where geohash = _sub_geohash and list_id = _list_id;
-  if not found then
-    begin
-      insert into list_geohash_600 (list_id, geohash, n_points, avg_latitude, avg_longitude) values (_list_id, _sub_geohash, 1, _latitude, _longitude);
-    exception when others then
-      update list_geohash_600 set n_points=n_points+1,
-            avg_latitude = (avg_latitude * n_points + _latitude) / (n_points + 1),
-            avg_longitude = (avg_longitude * n_points + _longitude) / (n_points + 1)
-      where list_id = _list_id and geohash = _sub_geohash;
-    end;
-  else
-    update list_geohash_600 set n_points=n_points+1,
-            avg_latitude = (avg_latitude * n_points + _latitude) / (n_points + 1),
-            avg_longitude = (avg_longitude * n_points + _longitude) / (n_points + 1)
-    where list_id = _list_id and geohash = _sub_geohash;
-  end if;
 
-  select substring(_geohash for 14) into _sub_geohash;
-  select id into _geohash_id from list_geohash_1200 where geohash = _sub_geohash and list_id = _list_id;
-  if not found then
-    begin
-      insert into list_geohash_1200 (list_id, geohash, n_points, avg_latitude, avg_longitude) values (_list_id, _sub_geohash, 1, _latitude, _longitude);
-    exception when others then
-      update list_geohash_1200 set n_points=n_points+1,
-            avg_latitude = (avg_latitude * n_points + _latitude) / (n_points + 1),
-            avg_longitude = (avg_longitude * n_points + _longitude) / (n_points + 1)
-      where list_id = _list_id and geohash = _sub_geohash;
-    end;
-  else
-    update list_geohash_1200 set n_points=n_points+1,
-            avg_latitude = (avg_latitude * n_points + _latitude) / (n_points + 1),
-            avg_longitude = (avg_longitude * n_points + _longitude) / (n_points + 1)
-    where list_id = _list_id and geohash = _sub_geohash;
-  end if;
 
-  select substring(_geohash for 13) into _sub_geohash;
-  select id into _geohash_id from list_geohash_2400 where geohash = _sub_geohash and list_id = _list_id;
-  if not found then
-    begin
-      insert into list_geohash_2400 (list_id, geohash, n_points, avg_latitude, avg_longitude) values (_list_id, _sub_geohash, 1, _latitude, _longitude);
-    exception when others then
-      update list_geohash_2400 set n_points=n_points+1,
-            avg_latitude = (avg_latitude * n_points + _latitude) / (n_points + 1),
-            avg_longitude = (avg_longitude * n_points + _longitude) / (n_points + 1)
-      where list_id = _list_id and geohash = _sub_geohash;
-    end;
-  else
-    update list_geohash_2400 set n_points=n_points+1,
-            avg_latitude = (avg_latitude * n_points + _latitude) / (n_points + 1),
-            avg_longitude = (avg_longitude * n_points + _longitude) / (n_points + 1)
-    where list_id = _list_id and geohash = _sub_geohash;
-  end if;
+--- remove_geohash_from_list
+--- the point must already be removed from list_point, or moved to its new
+--- coordinates, the bounds of the zones are recomputed when the point was
+--- on them, from the points of the deepest zone then from the child zones of
+--- each level, so only a few rows are read whatever the size of the list
+create or replace function remove_geohash_from_list(_list_id integer,
+                           _geohash character varying,
+                           _latitude numeric(30,27),
+                           _longitude numeric(30,27))
+               returns void as $$
+declare
+  _level integer;
+  _prefix character varying;
+  _zone record;
+  _bounds record;
+begin
+  update list_zone set n_points = n_points - 1,
+    sum_latitude = sum_latitude - _latitude,
+    sum_longitude = sum_longitude - _longitude
+  where list_id = _list_id and (level, geohash) in (select l, substring(_geohash for l) from zone_levels() as l);
+  delete from list_zone where list_id = _list_id and n_points <= 0;
+
+  for _level in select l from zone_levels() as l order by l desc loop
+    _prefix := substring(_geohash for _level);
+    select id, min_latitude, min_longitude, max_latitude, max_longitude into _zone
+      from list_zone where list_id = _list_id and level = _level and geohash = _prefix;
+    if not found or not (_latitude in (_zone.min_latitude, _zone.max_latitude) or _longitude in (_zone.min_longitude, _zone.max_longitude)) then
+      continue;
+    end if;
 
-  select substring(_geohash for 12) into _sub_geohash;
-  select id into _geohash_id from list_geohash_4800 where geohash = _sub_geohash and list_id = _list_id;
-  if not found then
-    begin
-      insert into list_geohash_4800 (list_id, geohash, n_points, avg_latitude, avg_longitude) values (_list_id, _sub_geohash, 1, _latitude, _longitude);
-    exception when others then
-      update list_geohash_4800 set n_points=n_points+1,
-            avg_latitude = (avg_latitude * n_points + _latitude) / (n_points + 1),
-            avg_longitude = (avg_longitude * n_points + _longitude) / (n_points + 1)
-      where list_id = _list_id and geohash = _sub_geohash;
-    end;
-  else
-    update list_geohash_4800 set n_points=n_points+1,
-            avg_latitude = (avg_latitude * n_points + _latitude) / (n_points + 1),
-            avg_longitude = (avg_longitude * n_points + _longitude) / (n_points + 1)
-    where list_id = _list_id and geohash = _sub_geohash;
-  end if;
+    if _level = zone_max_level() then
+      select min(point.latitude) as min_latitude, min(point.longitude) as min_longitude,
+          max(point.latitude) as max_latitude, max(point.longitude) as max_longitude into _bounds
+        from point
+        where point.geohash = _prefix::character(17)
+        and exists(select 1 from list_point where list_point.list_id = _list_id and list_point.point_id = point.id);
+    else
+      --- the geohash digits are 0 to 3, the children of the zone are between
+      --- the prefix and the prefix followed by 4
+      select min(z.min_latitude) as min_latitude, min(z.min_longitude) as min_longitude,
+          max(z.max_latitude) as max_latitude, max(z.max_longitude) as max_longitude into _bounds
+        from list_zone z
+        where z.list_id = _list_id and z.level = _level + 1
+        and z.geohash >= _prefix and z.geohash < _prefix || '4';
+    end if;
 
-  select substring(_geohash for 11) into _sub_geohash;
-  select id into _geohash_id from list_geohash_9600 where geohash = _sub_geohash and list_id = _list_id;
-  if not found then
-    begin
-      insert into list_geohash_9600 (list_id, geohash, n_points, avg_latitude, avg_longitude) values (_list_id, _sub_geohash, 1, _latitude, _longitude);
-    exception when others then
-      update list_geohash_9600 set n_points=n_points+1,
-            avg_latitude = (avg_latitude * n_points + _latitude) / (n_points + 1),
-            avg_longitude = (avg_longitude * n_points + _longitude) / (n_points + 1)
-      where list_id = _list_id and geohash = _sub_geohash;
-    end;
-  else
-    update list_geohash_9600 set n_points=n_points+1,
-            avg_latitude = (avg_latitude * n_points + _latitude) / (n_points + 1),
-            avg_longitude = (avg_longitude * n_points + _longitude) / (n_points + 1)
-    where list_id = _list_id and geohash = _sub_geohash;
-  end if;
+    update list_zone set min_latitude = _bounds.min_latitude,
+      min_longitude = _bounds.min_longitude,
+      max_latitude = _bounds.max_latitude,
+      max_longitude = _bounds.max_longitude
+    where id = _zone.id;
+  end loop;
+end;
+$$ language plpgsql;
 
-  select substring(_geohash for 10) into _sub_geohash;
-  select id into _geohash_id from list_geohash_20000 where geohash = _sub_geohash and list_id = _list_id;
-  if not found then
-    begin
-      insert into list_geohash_20000 (list_id, geohash, n_points, avg_latitude, avg_longitude) values (_list_id, _sub_geohash, 1, _latitude, _longitude);
-    exception when others then
-      update list_geohash_20000 set n_points=n_points+1,
-            avg_latitude = (avg_latitude * n_points + _latitude) / (n_points + 1),
-            avg_longitude = (avg_longitude * n_points + _longitude) / (n_points + 1)
-      where list_id = _list_id and geohash = _sub_geohash;
-    end;
-  else
-    update list_geohash_20000 set n_points=n_points+1,
-            avg_latitude = (avg_latitude * n_points + _latitude) / (n_points + 1),
-            avg_longitude = (avg_longitude * n_points + _longitude) / (n_points + 1)
-    where list_id = _list_id and geohash = _sub_geohash;
-  end if;
 
-  select substring(_geohash for 9) into _sub_geohash;
-  select id into _geohash_id from list_geohash_40000 where geohash = _sub_geohash and list_id = _list_id;
-  if not found then
-    begin
-      insert into list_geohash_40000 (list_id, geohash, n_points, avg_latitude, avg_longitude) values (_list_id, _sub_geohash, 1, _latitude, _longitude);
-    exception when others then
-      update list_geohash_40000 set n_points=n_points+1,
-            avg_latitude = (avg_latitude * n_points + _latitude) / (n_points + 1),
-            avg_longitude = (avg_longitude * n_points + _longitude) / (n_points + 1)
-      where list_id = _list_id and geohash = _sub_geohash;
-    end;
-  else
-    update list_geohash_40000 set n_points=n_points+1,
-            avg_latitude = (avg_latitude * n_points + _latitude) / (n_points + 1),
-            avg_longitude = (avg_longitude * n_points + _longitude) / (n_points + 1)
-    where list_id = _list_id and geohash = _sub_geohash;
-  end if;
 
-  select substring(_geohash for 8) into _sub_geohash;
-  select id into _geohash_id from list_geohash_80000 where geohash = _sub_geohash and list_id = _list_id;
-  if not found then
-    begin
-      insert into list_geohash_80000 (list_id, geohash, n_points, avg_latitude, avg_longitude) values (_list_id, _sub_geohash, 1, _latitude, _longitude);
-    exception when others then
-      update list_geohash_80000 set n_points=n_points+1,
-            avg_latitude = (avg_latitude * n_points + _latitude) / (n_points + 1),
-            avg_longitude = (avg_longitude * n_points + _longitude) / (n_points + 1)
-      where list_id = _list_id and geohash = _sub_geohash;
-    end;
-  else
-    update list_geohash_80000 set n_points=n_points+1,
-            avg_latitude = (avg_latitude * n_points + _latitude) / (n_points + 1),
-            avg_longitude = (avg_longitude * n_points + _longitude) / (n_points + 1)
-    where list_id = _list_id and geohash = _sub_geohash;
-  end if;
 
-  select substring(_geohash for 7) into _sub_geohash;
-  select id into _geohash_id from list_geohash_156000 where geohash = _sub_geohash and list_id = _list_id;
-  if not found then
-    begin
-      insert into list_geohash_156000 (list_id, geohash, n_points, avg_latitude, avg_longitude) values (_list_id, _sub_geohash, 1, _latitude, _longitude);
-    exception when others then
-      update list_geohash_156000 set n_points=n_points+1,
-            avg_latitude = (avg_latitude * n_points + _latitude) / (n_points + 1),
-            avg_longitude = (avg_longitude * n_points + _longitude) / (n_points + 1)
-      where list_id = _list_id and geohash = _sub_geohash;
-    end;
-  else
-    update list_geohash_156000 set n_points=n_points+1,
-            avg_latitude = (avg_latitude * n_points + _latitude) / (n_points + 1),
-            avg_longitude = (avg_longitude * n_points + _longitude) / (n_points + 1)
-    where list_id = _list_id and geohash = _sub_geohash;
-  end if;
-
-  select substring(_geohash for 6) into _sub_geohash;
-  select id into _geohash_id from list_geohash_312000 where geohash = _sub_geohash and list_id = _list_id;
-  if not found then
-    begin
-      insert into list_geohash_312000 (list_id, geohash, n_points, avg_latitude, avg_longitude) values (_list_id, _sub_geohash, 1, _latitude, _longitude);
-    exception when others then
-      update list_geohash_312000 set n_points=n_points+1,
-            avg_latitude = (avg_latitude * n_points + _latitude) / (n_points + 1),
-            avg_longitude = (avg_longitude * n_points + _longitude) / (n_points + 1)
-      where list_id = _list_id and geohash = _sub_geohash;
-    end;
-  else
-    update list_geohash_312000 set n_points=n_points+1,
-            avg_latitude = (avg_latitude * n_points + _latitude) / (n_points + 1),
-            avg_longitude = (avg_longitude * n_points + _longitude) / (n_points + 1)
-    where list_id = _list_id and geohash = _sub_geohash;
-  end if;
-
-  select substring(_geohash for 5) into _sub_geohash;
-  select id into _geohash_id from list_geohash_625000 where geohash = _sub_geohash and list_id = _list_id;
+--- rebuild_list_zones
+--- recomputes the zones of the list from list_point, returns the zones
+--- that were different
+create or replace function rebuild_list_zones(_identifier character(50))
+               returns table (zone_level integer,
+                      zone_geohash character varying,
+                      stored_n_points integer,
+                      actual_n_points integer,
+                      latitude_drift numeric,
+                      longitude_drift numeric)
+               as $$
+declare
+  _list_id integer;
+begin
+  select list.id into _list_id from list where list.identifier = _identifier;
   if not found then
-    begin
-      insert into list_geohash_625000 (list_id, geohash, n_points, avg_latitude, avg_longitude) values (_list_id, _sub_geohash, 1, _latitude, _longitude);
-    exception when others then
-      update list_geohash_625000 set n_points=n_points+1,
-            avg_latitude = (avg_latitude * n_points + _latitude) / (n_points + 1),
-            avg_longitude = (avg_longitude * n_points + _longitude) / (n_points + 1)
-      where list_id = _list_id and geohash = _sub_geohash;
-    end;
-  else
-    update list_geohash_625000 set n_points=n_points+1,
-            avg_latitude = (avg_latitude * n_points + _latitude) / (n_points + 1),
-            avg_longitude = (avg_longitude * n_points + _longitude) / (n_points + 1)
-    where list_id = _list_id and geohash = _sub_geohash;
+    raise exception 'Identifier lookup failed';
   end if;
 
+  create temporary table _actual_zone as
+    select l as level, substring(point.geohash for l)::character varying as geohash, count(*)::integer as n_points,
+        sum(point.latitude) as sum_latitude, sum(point.longitude) as sum_longitude,
+        min(point.latitude) as min_latitude, min(point.longitude) as min_longitude,
+        max(point.latitude) as max_latitude, max(point.longitude) as max_longitude
+    from list_point
+    inner join point on (point.id = list_point.point_id), zone_levels() as l
+    where list_point.list_id = _list_id
+    group by l, substring(point.geohash for l);
+
+  return query select coalesce(z.level, a.level),
+            coalesce(z.geohash, a.geohash),
+            coalesce(z.n_points, 0),
+            coalesce(a.n_points, 0),
+            coalesce(z.sum_latitude / z.n_points, 0) - coalesce(a.sum_latitude / a.n_points, 0),
+            coalesce(z.sum_longitude / z.n_points, 0) - coalesce(a.sum_longitude / a.n_points, 0)
+    from (select * from list_zone where list_zone.list_id = _list_id) as z
+    full outer join _actual_zone a on (a.level = z.level and a.geohash = z.geohash)
+    where z.id is null or a.level is null
+    or z.n_points != a.n_points
+    or z.sum_latitude != a.sum_latitude or z.sum_longitude != a.sum_longitude
+    or z.min_latitude != a.min_latitude or z.min_longitude != a.min_longitude
+    or z.max_latitude != a.max_latitude or z.max_longitude != a.max_longitude
+    order by 1, 2;
+
+  delete from list_zone where list_zone.list_id = _list_id;
+  insert into list_zone (list_id, level, geohash, n_points, sum_latitude, sum_longitude, min_latitude, min_longitude, max_latitude, max_longitude)
+    select _list_id, a.level, a.geohash, a.n_points, a.sum_latitude, a.sum_longitude, a.min_latitude, a.min_longitude, a.max_latitude, a.max_longitude
+    from _actual_zone a;
+
+  drop table _actual_zone;
 end;
 $$ language plpgsql;
 
 
 
 
---- remove_geohash_from_list
-create or replace function remove_geohash_from_list(_list_id integer, _geohash character) returns void as $$
+--- import_list_points
+--- creates the points of the import_point temporary table, filled with
+--- copy, and adds them to the list, the zones are updated once per geohash,
+--- returns the number of points
+create or replace function import_list_points(_list_identifier character(50),
+                        _version character varying,
+                        _no_event boolean)
+               returns integer as $$
 declare
-  _sub_geohash character varying;
+  _list_id integer;
+  _n_points integer;
 begin
-  select _geohash into _sub_geohash;
-  if found then
-    update list_geohash set n_points=n_points-1 where geohash = _sub_geohash and list_id = _list_id;
-  end if;
-
-  select substring(_geohash for 16) into _sub_geohash;
-  if found then
-    update list_geohash_300 set n_points=n_points-1 where geohash = _sub_geohash and list_id = _list_id;
-  end if;
-
-  select substring(_geohash for 15) into _sub_geohash;
-  if found then
-    update list_geohash_600 set n_points=n_points-1 where geohash = _sub_geohash and list_id = _list_id;
-  end if;
-
-  select substring(_geohash for 14) into _sub_geohash;
-  if found then
-    update list_geohash_1200 set n_points=n_points-1 where geohash = _sub_geohash and list_id = _list_id;
-  end if;
-
-  select substring(_geohash for 13) into _sub_geohash;
-  if found then
-    update list_geohash_2400 set n_points=n_points-1 where geohash = _sub_geohash and list_id = _list_id;
-  end if;
-
-  select substring(_geohash for 12) into _sub_geohash;
-  if found then
-    update list_geohash_4800 set n_points=n_points-1 where geohash = _sub_geohash and list_id = _list_id;
-  end if;
-
-  select substring(_geohash for 11) into _sub_geohash;
-  if found then
-    update list_geohash_9600 set n_points=n_points-1 where geohash = _sub_geohash and list_id = _list_id;
-  end if;
-
-  select substring(_geohash for 10) into _sub_geohash;
-  if found then
-    update list_geohash_20000 set n_points=n_points-1 where geohash = _sub_geohash and list_id = _list_id;
-  end if;
-
-  select substring(_geohash for 9) into _sub_geohash;
-  if found then
-    update list_geohash_40000 set n_points=n_points-1 where geohash = _sub_geohash and list_id = _list_id;
-  end if;
-
-  select substring(_geohash for 8) into _sub_geohash;
-  if found then
-    update list_geohash_80000 set n_points=n_points-1 where geohash = _sub_geohash and list_id = _list_id;
-  end if;
-
-  select substring(_geohash for 7) into _sub_geohash;
-  if found then
-    update list_geohash_156000 set n_points=n_points-1 where geohash = _sub_geohash and list_id = _list_id;
+  select id into _list_id from list where identifier = _list_identifier;
+  if not found then
+    raise exception 'Identifier lookup failed';
   end if;
 
-  select substring(_geohash for 6) into _sub_geohash;
-  if found then
-    update list_geohash_312000 set n_points=n_points-1 where geohash = _sub_geohash and list_id = _list_id;
-  end if;
+  with inserted as (
+    insert into point (identifier, geohash, latitude, longitude, name, search_name, provider, provider_id, version)
+      select identifier, geohash, latitude, longitude, name, search_text(name), provider, provider_id, _version from import_point
+    returning id)
+  insert into list_point (list_id, point_id) select _list_id, inserted.id from inserted;
+  get diagnostics _n_points = row_count;
+
+  insert into list_zone (list_id, level, geohash, n_points, sum_latitude, sum_longitude, min_latitude, min_longitude, max_latitude, max_longitude)
+    select _list_id, l, substring(import_point.geohash for l), count(*),
+        sum(import_point.latitude), sum(import_point.longitude),
+        min(import_point.latitude), min(import_point.longitude), max(import_point.latitude), max(import_point.longitude)
+    from import_point, zone_levels() as l
+    group by l, substring(import_point.geohash for l)
+  on conflict (list_id, level, geohash) do update set n_points = list_zone.n_points + excluded.n_points,
+    sum_latitude = list_zone.sum_latitude + excluded.sum_latitude,
+    sum_longitude = list_zone.sum_longitude + excluded.sum_longitude,
+    min_latitude = least(list_zone.min_latitude, excluded.min_latitude),
+    min_longitude = least(list_zone.min_longitude, excluded.min_longitude),
+    max_latitude = greatest(list_zone.max_latitude, excluded.max_latitude),
+    max_longitude = greatest(list_zone.max_longitude, excluded.max_longitude);
 
-  select substring(_geohash for 5) into _sub_geohash;
-  if found then
-    update list_geohash_625000 set n_points=n_points-1 where geohash = _sub_geohash and list_id = _list_id;
+  if not _no_event then
+    insert into event (list_id, geohash, event, object_identifier, object_identifier2)
+      select _list_id, import_point.geohash, 5, import_point.identifier, null from import_point;
+  else
+    perform touch_list(_list_id);
   end if;
-
+  return _n_points;
 end;
 $$ language plpgsql;
 
@@ -8,6 +8,13 @@ create table api_access (
   name character(50) not null
 );
 
+--- extensions
+
+--- accent insensitive search
+create extension if not exists unaccent;
+--- indexed word matching of the search
+create extension if not exists pg_trgm;
+
 --- point models
 
 create table point (
@@ -20,6 +27,8 @@ create table point (
     longitude numeric(30,27) not null,
 
     name character varying(200) not null,
+    --- search_text(name), kept up to date with the name
+    search_name text not null default '',
     date_created timestamp(3) with time zone not null default now(),
 
     provider character varying(100) not null,
@@ -32,6 +41,7 @@ create unique index point_identifier_index on point (identifier);
 create index point_geohash_index on point (geohash bpchar_pattern_ops);
 create index point_provider_index on point (provider);
 create index point_provider_id_index on point (provider_id);
+create index point_search_name_index on point using gin (search_name gin_trgm_ops);
 
 --- list models
 
@@ -44,194 +54,43 @@ create table list (
     date_created timestamp(3) with time zone not null default now(),
     last_update timestamp(3) with time zone not null default now(),
 
+    --- clustering defaults, can be overridden per request
+    expand_threshold integer not null default 4,
+    max_zone_points integer not null default 200,
+    min_geohash_length integer not null default 5,
+    max_geohash_length integer not null default 17,
+    --- geohash or supercluster
+    cluster_engine character varying(20) not null default 'geohash',
+
     version character varying(10) not null
 );
 
 create unique index list_identifier_index on list (identifier);
 
---- geohash tables
-
-create table list_geohash (
-    id serial primary key,
-    list_id integer not null references list on delete cascade,
-
-    avg_latitude numeric(30,27) not null,
-    avg_longitude numeric(30,27) not null,
-
-    geohash character(17) not null,
-    n_points integer not null default 0,
-    CONSTRAINT u_constraint_geohash UNIQUE (list_id, geohash)
-);
-
-create index list_geohash_geohash_index on list_geohash (geohash);
-
-create table list_geohash_300 (
-    id serial primary key,
-    list_id integer not null references list on delete cascade,
-
-    avg_latitude numeric(30,27) not null,
-    avg_longitude numeric(30,27) not null,
-
-    geohash character(16) not null,
-    n_points integer not null default 0,
-    CONSTRAINT u_constraint_geohash_300 UNIQUE (list_id, geohash)
-);
-
-create index list_geohash_300_geohash_index on list_geohash_300 (geohash);
-
-create table list_geohash_600 (
-    id serial primary key,
-    list_id integer not null references list on delete cascade,
-
-    avg_latitude numeric(30,27) not null,
-    avg_longitude numeric(30,27) not null,
-
-    geohash character(15) not null,
-    n_points integer not null default 0,
-    CONSTRAINT u_constraint_geohash_600 UNIQUE (list_id, geohash)
-);
-
-create index list_geohash_600_geohash_index on list_geohash_600 (geohash);
-
-create table list_geohash_1200 (
-    id serial primary key,
-    list_id integer not null references list on delete cascade,
-
-    avg_latitude numeric(30,27) not null,
-    avg_longitude numeric(30,27) not null,
-
-    geohash character(14) not null,
-    n_points integer not null default 0,
-    CONSTRAINT u_constraint_geohash_1200 UNIQUE (list_id, geohash)
-);
-
-create index list_geohash_1200_geohash_index on list_geohash_1200 (geohash);
-
-create table list_geohash_2400 (
-    id serial primary key,
-    list_id integer not null references list on delete cascade,
-
-    avg_latitude numeric(30,27) not null,
-    avg_longitude numeric(30,27) not null,
-
-    geohash character(13) not null,
-    n_points integer not null default 0,
-    CONSTRAINT u_constraint_geohash_2400 UNIQUE (list_id, geohash)
-);
-
-create index list_geohash_2400_geohash_index on list_geohash_2400 (geohash);
-
-create table list_geohash_4800 (
-    id serial primary key,
-    list_id integer not null references list on delete cascade,
-
-    avg_latitude numeric(30,27) not null,
-    avg_longitude numeric(30,27) not null,
-
-    geohash character(12) not null,
-    n_points integer not null default 0,
-    CONSTRAINT u_constraint_geohash_4800 UNIQUE (list_id, geohash)
-);
-
-create index list_geohash_4800_geohash_index on list_geohash_4800 (geohash);
-
-create table list_geohash_9600 (
-    id serial primary key,
-    list_id integer not null references list on delete cascade,
-
-    avg_latitude numeric(30,27) not null,
-    avg_longitude numeric(30,27) not null,
-
-    geohash character(11) not null,
-    n_points integer not null default 0,
-    CONSTRAINT u_constraint_geohash_9600 UNIQUE (list_id, geohash)
-);
-
-create index list_geohash_9600_geohash_index on list_geohash_9600 (geohash);
-
-create table list_geohash_20000 (
-    id serial primary key,
-    list_id integer not null references list on delete cascade,
-
-    avg_latitude numeric(30,27) not null,
-    avg_longitude numeric(30,27) not null,
-
-    geohash character(10) not null,
-    n_points integer not null default 0,
-    CONSTRAINT u_constraint_geohash_20000 UNIQUE (list_id, geohash)
-);
-
-create index list_geohash_20000_geohash_index on list_geohash_20000 (geohash);
-
-create table list_geohash_40000 (
-    id serial primary key,
-    list_id integer not null references list on delete cascade,
-
-    avg_latitude numeric(30,27) not null,
-    avg_longitude numeric(30,27) not null,
-
-    geohash character(9) not null,
-    n_points integer not null default 0,
-    CONSTRAINT u_constraint_geohash_40000 UNIQUE (list_id, geohash)
-);
-
-create index list_geohash_40000_geohash_index on list_geohash_40000 (geohash);
+--- zone table
 
-create table list_geohash_80000 (
+--- the points of a list aggregated by geohash, for every geohash length
+--- between zone_min_level() and zone_max_level(), level is the length of
+--- the geohash
+create table list_zone (
     id serial primary key,
     list_id integer not null references list on delete cascade,
+    level integer not null,
 
-    avg_latitude numeric(30,27) not null,
-    avg_longitude numeric(30,27) not null,
-
-    geohash character(8) not null,
+    geohash character varying(17) not null,
     n_points integer not null default 0,
-    CONSTRAINT u_constraint_80000 UNIQUE (list_id, geohash)
-);
-
-create index list_geohash_80000_geohash_index on list_geohash_80000 (geohash);
-
-create table list_geohash_156000 (
-    id serial primary key,
-    list_id integer not null references list on delete cascade,
 
-    avg_latitude numeric(30,27) not null,
-    avg_longitude numeric(30,27) not null,
+    sum_latitude numeric not null,
+    sum_longitude numeric not null,
 
-    geohash character(7) not null,
-    n_points integer not null default 0,
-    CONSTRAINT u_constraint_geohash_156000 UNIQUE (list_id, geohash)
+    min_latitude numeric(30,27) not null,
+    min_longitude numeric(30,27) not null,
+    max_latitude numeric(30,27) not null,
+    max_longitude numeric(30,27) not null,
+    CONSTRAINT u_constraint_list_zone UNIQUE (list_id, level, geohash)
 );
 
-create index list_geohash_156000_geohash_index on list_geohash_156000 (geohash);
-
-create table list_geohash_312000 (
-    id serial primary key,
-    list_id integer not null references list on delete cascade,
-
-    avg_latitude numeric(30,27) not null,
-    avg_longitude numeric(30,27) not null,
-
-    geohash character(6) not null,
-    n_points integer not null default 0,
-    CONSTRAINT u_constraint_geohash_312000 UNIQUE (list_id, geohash)
-);
-
-create index list_geohash_312000_geohash_index on list_geohash_312000 (geohash);
-
-create table list_geohash_625000 (
-    id serial primary key,
-    list_id integer not null references list on delete cascade,
-
-    avg_latitude numeric(30,27) not null,
-    avg_longitude numeric(30,27) not null,
-
-    geohash character(5) not null,
-    n_points integer not null default 0,
-    CONSTRAINT u_constraint_geohash_625000 UNIQUE (list_id, geohash)
-);
-
-create index list_geohash_625000_geohash_index on list_geohash_625000 (geohash);
+create index list_zone_geohash_index on list_zone (level, geohash);
 
 create table list_meta (
     id serial primary key,
@@ -255,6 +114,8 @@ create table list_point (
     date_created timestamp(3) with time zone not null default now()
 );
 
+create index list_point_date_created_index on list_point (list_id, date_created, point_id);
+
 create table point_meta (
     id serial primary key,
     identifier character(50) not null unique,
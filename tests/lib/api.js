@@ -65,6 +65,23 @@ module.exports.addPointToList = function(list, point, after) {
   .toss();
 }
 
+module.exports.addPointToListReturnZone = function(list, point, expect, after) {
+  frisby.create('add point to list with return_zone')
+  .post(URL + '/list/' + list + '/point/' + point + '/?return_zone=true')
+  .addHeader('X-ParsemapAppKey', TEST_KEY)
+  .expectHeaderContains('Content-Type', 'json')
+  .expectStatus(201)
+  .expectJSONTypes({
+    geohash: String,
+    n_points: Number,
+    latitude: Number,
+    longitude: Number,
+  })
+  .expectJSON(expect)
+  .afterJSON(after)
+  .toss();
+}
+
 module.exports.createPointMeta = function(point, list, after) {
   let images = ['http://i.imgur.com/slGGjh9.png', 'http://i.imgur.com/WcWg3xo.jpg', 'http://i.imgur.com/zpwvN7W.jpg', 'http://i.imgur.com/s9zmKAG.jpg'];
   frisby.create('add point meta')
@@ -127,3 +144,12 @@ module.exports.getPointsFromList = function(list, attrs, expect, after) {
   .afterJSON(after)
   .toss();
 }
+
+module.exports.getListZones = function(list, after) {
+  frisby.create('get list zones')
+  .get(URL + '/list/' + list + '/zones/')
+  .expectHeaderContains('Content-Type', 'json')
+  .expectStatus(200)
+  .afterJSON(after)
+  .toss();
+}
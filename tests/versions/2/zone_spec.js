@@ -0,0 +1,28 @@
+'use strict';
+
+let api = require("../../lib/api");
+
+api.createList('Test zone list', function(list) {
+  api.createPoint(48.48266193, 2.409832523, function(point) {
+    api.addPointToListReturnZone(list.identifier, point.identifier, {
+      n_points: 1,
+      latitude: 48.48266193,
+      longitude: 2.409832523,
+    }, function(zone) {
+      api.removePoint(point.identifier, function() {});
+    });
+  });
+});
+
+// a list without clustering settings starts at the zones of length 5
+api.createList('Test zone levels list', function(list) {
+  api.createPoint(48.48266193, 2.409832523, function(point) {
+    api.addPointToList(list.identifier, point.identifier, function() {
+      api.getListZones(list.identifier, function(zones) {
+        expect(zones.length).toEqual(1);
+        expect(zones[0].geohash.length).toEqual(5);
+        api.removePoint(point.identifier, function() {});
+      });
+    });
+  });
+});